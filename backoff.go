@@ -0,0 +1,117 @@
+package pgxwrapper
+
+import (
+	"context"
+	"errors"
+	"math/rand/v2"
+	"time"
+)
+
+// errRetryBudgetExhausted ошибка, когда следующая попытка не укладывается в RetryPolicy.Budget
+var errRetryBudgetExhausted = errors.New("retry budget exhausted")
+
+// BackoffStrategy стратегия вычисления задержки между повторными попытками
+type BackoffStrategy int
+
+const (
+	// BackoffConstant постоянная задержка BaseDelay
+	BackoffConstant BackoffStrategy = iota
+
+	// BackoffExponential задержка BaseDelay, умножаемая на Multiplier после каждой попытки
+	BackoffExponential
+
+	// BackoffDecorrelatedJitter случайная задержка от BaseDelay до утроенной предыдущей задержки
+	BackoffDecorrelatedJitter
+)
+
+// RetryPolicy политика повторных попыток
+type RetryPolicy struct {
+	// Strategy стратегия вычисления задержки
+	Strategy BackoffStrategy
+
+	// BaseDelay начальная задержка. По умолчанию используется Config.RetryDelay
+	BaseDelay time.Duration
+
+	// MaxDelay максимальная задержка между попытками. 0 - без ограничения
+	MaxDelay time.Duration
+
+	// Multiplier множитель задержки для BackoffExponential. По умолчанию 2
+	Multiplier float64
+
+	// Budget общее время, в течение которого допускаются повторные попытки,
+	// считая от первой попытки. 0 - без ограничения
+	Budget time.Duration
+}
+
+// backoff последовательность задержек между попытками одной операции
+type backoff struct {
+	policy RetryPolicy
+	start  time.Time
+	prev   time.Duration
+}
+
+// newBackoff создает последовательность задержек по политике повторных попыток
+func newBackoff(policy RetryPolicy) *backoff {
+	if policy.Multiplier <= 1 {
+		policy.Multiplier = 2
+	}
+	return &backoff{policy: policy, start: time.Now()}
+}
+
+// newBackoff создает последовательность задержек по политике из конфигурации
+func (db *DB) newBackoff() *backoff {
+	policy := db.config.RetryPolicy
+	if policy.BaseDelay <= 0 {
+		policy.BaseDelay = db.config.RetryDelay
+	}
+	return newBackoff(policy)
+}
+
+// next возвращает задержку перед следующей попыткой
+func (b *backoff) next() time.Duration {
+	p := b.policy
+
+	var delay time.Duration
+	switch {
+	case b.prev == 0 || p.Strategy == BackoffConstant:
+		delay = p.BaseDelay
+	case p.Strategy == BackoffExponential:
+		delay = time.Duration(float64(b.prev) * p.Multiplier)
+	case p.Strategy == BackoffDecorrelatedJitter:
+		upper := 3 * b.prev
+		delay = p.BaseDelay
+		if upper > p.BaseDelay {
+			delay += rand.N(upper - p.BaseDelay)
+		}
+	}
+
+	if p.MaxDelay > 0 && delay > p.MaxDelay {
+		delay = p.MaxDelay
+	}
+	b.prev = max(delay, time.Nanosecond)
+	return delay
+}
+
+// wait ожидает задержку перед следующей попыткой.
+// Прерывается при отмене контекста; если попытка не укладывается в бюджет,
+// возвращает errRetryBudgetExhausted без ожидания
+func (b *backoff) wait(ctx context.Context) error {
+	delay := b.next()
+	if b.policy.Budget > 0 && time.Since(b.start)+delay > b.policy.Budget {
+		return errRetryBudgetExhausted
+	}
+	return sleepContext(ctx, delay)
+}
+
+// sleepContext ожидает заданное время или отмены контекста
+func sleepContext(ctx context.Context, delay time.Duration) error {
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
@@ -0,0 +1,145 @@
+package pgxwrapper
+
+import (
+	"math/rand/v2"
+	"sort"
+	"sync/atomic"
+)
+
+// ReplicaInfo информация об асинхронной реплике, передаваемая балансировщику
+type ReplicaInfo struct {
+	// Index номер реплики в конфигурации, не зависящий от текущего состава реплик:
+	// индекс в общем списке строк подключения, где первой идет Config.AsyncSlaveConnString
+	// (если задана), а за ней непустые Config.AsyncSlaveConnStrings. При заданном Config.Hosts -
+	// индекс узла в Config.Hosts
+	Index int
+
+	// Name имя реплики
+	Name string
+
+	// InFlight количество операций, выполняющихся на реплике в данный момент.
+	// Query учитывается до закрытия Rows, QueryRow - до вызова Scan
+	InFlight int64
+}
+
+// Balancer стратегия распределения запросов между асинхронными репликами
+type Balancer interface {
+	// Order возвращает позиции реплик в срезе replicas (не ReplicaInfo.Index) в порядке обхода:
+	// первая реплика используется для запроса, остальные - для переключения при ошибках
+	Order(replicas []ReplicaInfo) []int
+}
+
+// roundRobinBalancer балансировщик, перебирающий реплики по кругу
+type roundRobinBalancer struct {
+	next atomic.Uint64
+}
+
+// NewRoundRobinBalancer создает балансировщик, перебирающий реплики по кругу
+func NewRoundRobinBalancer() Balancer {
+	return &roundRobinBalancer{}
+}
+
+// Order возвращает реплики, начиная со следующей по кругу
+func (b *roundRobinBalancer) Order(replicas []ReplicaInfo) []int {
+	if len(replicas) == 0 {
+		return nil
+	}
+	start := int(b.next.Add(1)-1) % len(replicas)
+	return rotate(len(replicas), start)
+}
+
+// randomBalancer балансировщик, выбирающий реплики случайно
+type randomBalancer struct{}
+
+// NewRandomBalancer создает балансировщик, выбирающий реплики случайно
+func NewRandomBalancer() Balancer {
+	return randomBalancer{}
+}
+
+// Order возвращает реплики в случайном порядке
+func (randomBalancer) Order(replicas []ReplicaInfo) []int {
+	return rand.Perm(len(replicas))
+}
+
+// leastInFlightBalancer балансировщик, выбирающий наименее загруженную реплику
+type leastInFlightBalancer struct {
+	next atomic.Uint64
+}
+
+// NewLeastInFlightBalancer создает балансировщик, выбирающий реплику
+// с наименьшим количеством выполняющихся операций
+func NewLeastInFlightBalancer() Balancer {
+	return &leastInFlightBalancer{}
+}
+
+// Order возвращает реплики по возрастанию нагрузки.
+// Реплики с одинаковой нагрузкой перебираются по кругу
+func (b *leastInFlightBalancer) Order(replicas []ReplicaInfo) []int {
+	if len(replicas) == 0 {
+		return nil
+	}
+	start := int(b.next.Add(1)-1) % len(replicas)
+	order := rotate(len(replicas), start)
+	sort.SliceStable(order, func(i, j int) bool {
+		return replicas[order[i]].InFlight < replicas[order[j]].InFlight
+	})
+	return order
+}
+
+// weightedBalancer балансировщик, выбирающий реплики случайно с учетом весов
+type weightedBalancer struct {
+	weights []int
+}
+
+// NewWeightedBalancer создает балансировщик, выбирающий реплики случайно
+// пропорционально весам. weights[i] - вес реплики с ReplicaInfo.Index == i: i-й строки подключения
+// (AsyncSlaveConnString, затем AsyncSlaveConnStrings) или i-го узла Config.Hosts. Реплики без веса получают вес 1, реплики с нулевым весом используются только для переключения
+func NewWeightedBalancer(weights ...int) Balancer {
+	return &weightedBalancer{weights: weights}
+}
+
+// weight возвращает вес реплики
+func (b *weightedBalancer) weight(replica ReplicaInfo) int {
+	if replica.Index < len(b.weights) {
+		return max(b.weights[replica.Index], 0)
+	}
+	return 1
+}
+
+// Order возвращает реплики в порядке взвешенной случайной выборки без возвращения
+func (b *weightedBalancer) Order(replicas []ReplicaInfo) []int {
+	remaining := rotate(len(replicas), 0)
+	order := make([]int, 0, len(replicas))
+
+	for len(remaining) > 0 {
+		total := 0
+		for _, i := range remaining {
+			total += b.weight(replicas[i])
+		}
+		if total == 0 {
+			// Остались только реплики с нулевым весом
+			break
+		}
+
+		pick := rand.IntN(total)
+		for k, i := range remaining {
+			pick -= b.weight(replicas[i])
+			if pick < 0 {
+				order = append(order, i)
+				remaining = append(remaining[:k], remaining[k+1:]...)
+				break
+			}
+		}
+	}
+
+	return append(order, remaining...)
+}
+
+// rotate возвращает индексы 0..n-1, начиная со start
+func rotate(n, start int) []int {
+	order := make([]int, n)
+	for i := range order {
+		order[i] = (start + i) % n
+	}
+	return order
+}
@@ -0,0 +1,239 @@
+package pgxwrapper
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// batchResults обертка для результатов пакета запросов.
+// Возвращает подключение в пул, отменяет таймаут и завершает операцию при закрытии
+type batchResults struct {
+	results pgx.BatchResults
+	db      *DB
+
+	// err ошибка отправки пакета, возвращаемая всеми методами
+	err error
+
+	// release возвращает подключение в пул
+	release func()
+
+	// cancel отменяет таймаут пакета
+	cancel context.CancelFunc
+
+	// done завершает операцию отправки пакета
+	done func(err error)
+
+	// failover запросить проверку ролей, если запись отклонена бывшим мастером
+	failover bool
+
+	closed bool
+}
+
+// fail записывает ошибку запроса из пакета в телеметрию
+func (br *batchResults) fail(err error) error {
+	if br.db.telemetry != nil {
+		br.db.telemetry.RecordError()
+	}
+	if br.failover && isReadOnlyError(err) {
+		br.db.requestTopologyRefresh()
+	}
+	return fmt.Errorf("error executing batch query: %w", err)
+}
+
+// Exec возвращает результат следующей команды пакета
+func (br *batchResults) Exec() (pgconn.CommandTag, error) {
+	if br.err != nil {
+		return pgconn.CommandTag{}, br.err
+	}
+	tag, err := br.results.Exec()
+	if err != nil {
+		return tag, br.fail(err)
+	}
+	return tag, nil
+}
+
+// Query возвращает строки следующего запроса пакета
+func (br *batchResults) Query() (Rows, error) {
+	if br.err != nil {
+		return nil, br.err
+	}
+	rows, err := br.results.Query()
+	if err != nil {
+		if rows != nil {
+			rows.Close()
+		}
+		return nil, br.fail(err)
+	}
+	return &rowsWrapper{rows: rows}, nil
+}
+
+// QueryRow возвращает строку следующего запроса пакета
+func (br *batchResults) QueryRow() Row {
+	if br.err != nil {
+		return errRow{err: br.err}
+	}
+	return &rowWrapper{row: br.results.QueryRow()}
+}
+
+// Close дочитывает результаты пакета и освобождает подключение
+func (br *batchResults) Close() error {
+	if br.closed {
+		return br.err
+	}
+	br.closed = true
+
+	if br.cancel != nil {
+		defer br.cancel()
+	}
+	if br.err != nil {
+		return br.err
+	}
+
+	err := br.results.Close()
+	if br.release != nil {
+		br.release()
+	}
+	if br.done != nil {
+		br.done(err)
+	}
+
+	if err != nil {
+		return br.fail(err)
+	}
+	return nil
+}
+
+// errRow строка, возвращающая ошибку при сканировании
+type errRow struct {
+	err error
+}
+
+// Scan возвращает ошибку строки
+func (r errRow) Scan(dest ...any) error {
+	return r.err
+}
+
+// batchSQL возвращает запросы пакета через "; " для перехватчиков, трассировки и статистики запросов
+func batchSQL(b *Batch) string {
+	queries := make([]string, len(b.QueuedQueries))
+	for i, q := range b.QueuedQueries {
+		queries[i] = q.SQL
+	}
+	return strings.Join(queries, "; ")
+}
+
+// sendBatch берет подключение из пула и отправляет на нем пакет запросов.
+// Ошибка получения подключения возвращается сразу, чтобы ее могли обработать
+// повторные попытки и переключение между узлами
+func (mc *masterConn) sendBatch(ctx context.Context, b *Batch, role string) (*batchResults, error) {
+	var cancel context.CancelFunc
+	if mc.db.config.QueryTimeout > 0 {
+		ctx, cancel = context.WithTimeout(ctx, mc.db.config.QueryTimeout)
+	}
+
+	ctx, op, err := mc.startOperation(ctx, OperationBatch, batchSQL(b), nil)
+	if err != nil {
+		if cancel != nil {
+			cancel()
+		}
+		return nil, err
+	}
+
+	var conn *pgxpool.Conn
+	err = mc.withReconnect(ctx, func(pool *pgxpool.Pool) (err error) {
+		conn, err = pool.Acquire(ctx)
+		return err
+	})
+	if err != nil {
+		op.end(err)
+		if cancel != nil {
+			cancel()
+		}
+		if mc.db.telemetry != nil {
+			mc.db.telemetry.RecordError()
+		}
+		mc.db.logger.ErrorContext(ctx, "Ошибка отправки пакета запросов на "+role, "error", err, "queries", b.Len())
+		return nil, fmt.Errorf("error sending batch to %s: %w", role, err)
+	}
+
+	mc.db.logger.DebugContext(ctx, "Отправлен пакет запросов на "+role, "queries", b.Len())
+	return &batchResults{
+		results:  conn.SendBatch(ctx, &b.Batch),
+		db:       mc.db,
+		release:  conn.Release,
+		cancel:   cancel,
+		done:     op.end,
+		failover: mc.failover,
+	}, nil
+}
+
+// SendBatch отправляет пакет запросов на мастер или во внешнюю транзакцию из контекста
+func (mc *masterConn) SendBatch(ctx context.Context, b *Batch) BatchResults {
+	if tx, ok := mc.ambientTx(ctx); ok {
+		return tx.SendBatch(ctx, b)
+	}
+
+	results, err := mc.sendBatch(ctx, b, "master")
+	if err != nil {
+		return &batchResults{db: mc.db, err: err}
+	}
+
+	// Пакет может содержать запись, поэтому позиция WAL запоминается после его успешного закрытия
+	end := results.done
+	results.done = func(err error) {
+		end(err)
+		if err == nil {
+			mc.captureCommitLSN(ctx)
+		}
+	}
+	return results
+}
+
+// SendBatch отправляет пакет запросов на реплику. Пакет должен содержать только запросы на чтение
+func (rc *replicaConn) SendBatch(ctx context.Context, b *Batch) BatchResults {
+	results, err := rc.sendBatch(ctx, b, "replica")
+	if err != nil {
+		return &batchResults{db: rc.db, err: err}
+	}
+	return results
+}
+
+// SendBatch отправляет пакет запросов в транзакции
+func (t *txWrapper) SendBatch(ctx context.Context, b *Batch) BatchResults {
+	ctx, op, err := t.startOperation(ctx, OperationBatch, batchSQL(b), nil)
+	if err != nil {
+		return &batchResults{db: t.db, err: err}
+	}
+
+	return &batchResults{
+		results:  t.tx.SendBatch(ctx, &b.Batch),
+		db:       t.db,
+		done:     op.end,
+		failover: !t.readOnly,
+	}
+}
+
+// SendBatch отправляет пакет запросов на чтение с повторными попытками и переключением
+// между репликами. Узел выбирается до отправки пакета: ошибки подключения к узлу
+// приводят к переходу на следующий, ошибки запросов возвращаются из BatchResults
+func (rc *retryableConn) SendBatch(ctx context.Context, b *Batch) BatchResults {
+	var result BatchResults
+
+	err := rc.manager.ExecuteQueryWithRetry(ctx, func(conn Conn) error {
+		result = conn.SendBatch(ctx, b)
+		if br, ok := result.(*batchResults); ok && br.err != nil {
+			return br.err
+		}
+		return nil
+	})
+	if err != nil {
+		return &batchResults{db: rc.manager.db, err: err}
+	}
+
+	return result
+}
@@ -0,0 +1,205 @@
+package pgxwrapper
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"slices"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/jackc/pgx/v5/pgtype"
+)
+
+const (
+	// defaultMaxBufferedRows ограничение количества строк буферизованного результата по умолчанию
+	defaultMaxBufferedRows = 10000
+
+	// defaultMaxBufferedBytes ограничение размера буферизованного результата по умолчанию
+	defaultMaxBufferedBytes = 16 << 20
+)
+
+// bufferRows читает все строки rows в память и закрывает rows.
+// Ошибка чтения строк возвращается сразу, чтобы ее могли обработать повторные попытки
+// и переключение между узлами. Значения преобразуются типами подключения, на котором
+// выполнен запрос, включая зарегистрированные на нем (например, в AfterConnect)
+func (db *DB) bufferRows(rows Rows) (Rows, error) {
+	rw, ok := rows.(*rowsWrapper)
+	if !ok {
+		return rows, nil
+	}
+	defer rw.Close()
+
+	maxRows := db.config.MaxBufferedRows
+	if maxRows <= 0 {
+		maxRows = defaultMaxBufferedRows
+	}
+	maxBytes := db.config.MaxBufferedBytes
+	if maxBytes <= 0 {
+		maxBytes = defaultMaxBufferedBytes
+	}
+
+	src := rw.rows
+	fields := slices.Clone(src.FieldDescriptions())
+	b := &bufferedRows{
+		typeMap: rowsTypeMap(src, fields),
+		fields:  fields,
+	}
+
+	var size int64
+	for src.Next() {
+		if len(b.rows) >= maxRows {
+			return nil, fmt.Errorf("%w: more than %d rows", ErrResultTooLarge, maxRows)
+		}
+
+		raw := src.RawValues()
+		row := make([][]byte, len(raw))
+		for i, value := range raw {
+			// bytes.Clone сохраняет различие между NULL (nil) и пустым значением
+			row[i] = bytes.Clone(value)
+			size += int64(len(value))
+		}
+		if size > maxBytes {
+			return nil, fmt.Errorf("%w: more than %d bytes", ErrResultTooLarge, maxBytes)
+		}
+
+		b.rows = append(b.rows, row)
+	}
+	if err := src.Err(); err != nil {
+		return nil, err
+	}
+
+	b.commandTag = src.CommandTag()
+	return b, nil
+}
+
+// rowsTypeMap возвращает типы для преобразования столбцов fields результата rows.
+// Типы столбцов берутся у подключения, на котором выполнен запрос, и копируются в новый
+// набор: после чтения строк подключение возвращается в пул, а pgtype.Map подключения
+// нельзя использовать конкурентно
+func rowsTypeMap(rows pgx.Rows, fields []pgconn.FieldDescription) *pgtype.Map {
+	m := pgtype.NewMap()
+	conn := rows.Conn()
+	if conn == nil {
+		return m
+	}
+
+	connTypes := conn.TypeMap()
+	for _, fd := range fields {
+		if dt, ok := connTypes.TypeForOID(fd.DataTypeOID); ok {
+			m.RegisterType(dt)
+		}
+	}
+	return m
+}
+
+// bufferedRows результат запроса, полностью прочитанный в память.
+// Реализует pgx.Rows, поэтому подходит для pgx.CollectRows и pgx.RowToStructByName
+type bufferedRows struct {
+	typeMap    *pgtype.Map
+	fields     []pgconn.FieldDescription
+	rows       [][][]byte
+	commandTag pgconn.CommandTag
+
+	// current номер текущей строки, начиная с 1
+	current int
+	closed  bool
+}
+
+// Close закрывает Rows
+func (b *bufferedRows) Close() {
+	b.closed = true
+}
+
+// Err возвращает ошибку. Ошибки чтения обрабатываются при буферизации
+func (b *bufferedRows) Err() error {
+	return nil
+}
+
+// CommandTag возвращает результат выполнения команды
+func (b *bufferedRows) CommandTag() pgconn.CommandTag {
+	return b.commandTag
+}
+
+// FieldDescriptions возвращает описания столбцов
+func (b *bufferedRows) FieldDescriptions() []pgconn.FieldDescription {
+	return b.fields
+}
+
+// ColumnTypes возвращает типы колонок
+func (b *bufferedRows) ColumnTypes() []any {
+	result := make([]any, len(b.fields))
+	for i, desc := range b.fields {
+		result[i] = desc
+	}
+	return result
+}
+
+// Next переходит к следующей строке
+func (b *bufferedRows) Next() bool {
+	if b.closed || b.current >= len(b.rows) {
+		b.closed = true
+		return false
+	}
+	b.current++
+	return true
+}
+
+// RawValues возвращает необработанные значения текущей строки
+func (b *bufferedRows) RawValues() [][]byte {
+	if b.current == 0 || b.current > len(b.rows) {
+		return nil
+	}
+	return b.rows[b.current-1]
+}
+
+// Scan сканирует значения текущей строки в переменные
+func (b *bufferedRows) Scan(dest ...any) error {
+	if b.current == 0 || b.current > len(b.rows) {
+		return errors.New("no current row")
+	}
+	if len(dest) == 1 {
+		if scanner, ok := dest[0].(pgx.RowScanner); ok {
+			return scanner.ScanRow(b)
+		}
+	}
+	return pgx.ScanRow(b.typeMap, b.fields, b.RawValues(), dest...)
+}
+
+// Values возвращает значения текущей строки
+func (b *bufferedRows) Values() ([]any, error) {
+	raw := b.RawValues()
+	if raw == nil {
+		return nil, errors.New("no current row")
+	}
+
+	values := make([]any, len(b.fields))
+	for i, fd := range b.fields {
+		if raw[i] == nil {
+			continue
+		}
+
+		if dt, ok := b.typeMap.TypeForOID(fd.DataTypeOID); ok {
+			value, err := dt.Codec.DecodeValue(b.typeMap, fd.DataTypeOID, fd.Format, raw[i])
+			if err != nil {
+				return nil, err
+			}
+			values[i] = value
+			continue
+		}
+
+		switch fd.Format {
+		case pgx.TextFormatCode:
+			values[i] = string(raw[i])
+		default:
+			values[i] = bytes.Clone(raw[i])
+		}
+	}
+
+	return values, nil
+}
+
+// Conn возвращает nil: подключение возвращено в пул после чтения результата
+func (b *bufferedRows) Conn() *pgx.Conn {
+	return nil
+}
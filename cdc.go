@@ -0,0 +1,616 @@
+package pgxwrapper
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/jackc/pgx/v5/pgproto3"
+	"github.com/jackc/pgx/v5/pgtype"
+)
+
+// defaultStandbyStatusInterval интервал отправки подтверждений по умолчанию
+const defaultStandbyStatusInterval = 10 * time.Second
+
+// pgEpoch начало отсчета времени в протоколе репликации
+var pgEpoch = time.Date(2000, time.January, 1, 0, 0, 0, 0, time.UTC)
+
+// ChangeStreamConfig параметры потока изменений
+type ChangeStreamConfig struct {
+	// Slot имя слота логической репликации. Слот создается, если его нет
+	Slot string
+
+	// TemporarySlot создать временный слот, удаляемый при закрытии подключения.
+	// Позиция во временном слоте не сохраняется между запусками
+	TemporarySlot bool
+
+	// Publication имя публикации. Публикация создается, если ее нет
+	Publication string
+
+	// Tables таблицы для новой публикации в виде "table" или "schema.table".
+	// Если не заданы, публикация создается для всех таблиц
+	Tables []string
+
+	// StandbyStatusInterval интервал отправки подтверждений серверу
+	StandbyStatusInterval time.Duration
+}
+
+// ChangeKind тип события потока изменений
+type ChangeKind int
+
+const (
+	// ChangeBegin начало транзакции
+	ChangeBegin ChangeKind = iota
+
+	// ChangeInsert вставка строки
+	ChangeInsert
+
+	// ChangeUpdate изменение строки
+	ChangeUpdate
+
+	// ChangeDelete удаление строки
+	ChangeDelete
+
+	// ChangeCommit фиксация транзакции
+	ChangeCommit
+)
+
+// String возвращает название типа события
+func (k ChangeKind) String() string {
+	switch k {
+	case ChangeBegin:
+		return "begin"
+	case ChangeInsert:
+		return "insert"
+	case ChangeUpdate:
+		return "update"
+	case ChangeDelete:
+		return "delete"
+	case ChangeCommit:
+		return "commit"
+	default:
+		return fmt.Sprintf("ChangeKind(%d)", int(k))
+	}
+}
+
+// ChangeEvent событие потока изменений
+type ChangeEvent struct {
+	// Kind тип события
+	Kind ChangeKind
+
+	// LSN позиция события в WAL. Для ChangeCommit - позиция конца транзакции,
+	// которая подтверждается после успешной обработки события
+	LSN LSN
+
+	// XID идентификатор транзакции
+	XID uint32
+
+	// CommitTime время фиксации транзакции
+	CommitTime time.Time
+
+	// Schema и Table таблица измененной строки
+	Schema string
+	Table  string
+
+	// New новые значения столбцов для ChangeInsert и ChangeUpdate.
+	// Неизмененные TOAST-значения отсутствуют в New
+	New map[string]any
+
+	// Old ключ или прежние значения строки для ChangeUpdate и ChangeDelete,
+	// если их передает REPLICA IDENTITY таблицы
+	Old map[string]any
+}
+
+// StreamChanges читает изменения строк с мастера через слот логической репликации
+// с плагином pgoutput и передает их handler в порядке фиксации транзакций.
+// После того как handler успешно обработал ChangeCommit, позиция транзакции подтверждается
+// серверу, поэтому после перезапуска чтение продолжается со следующей транзакции.
+// Функция блокируется до отмены ctx или ошибки handler или подключения
+func (db *DB) StreamChanges(ctx context.Context, cfg ChangeStreamConfig, handler func(context.Context, ChangeEvent) error) error {
+	if cfg.Slot == "" || cfg.Publication == "" {
+		return fmt.Errorf("%w: replication slot and publication are required", ErrInvalidConfiguration)
+	}
+	if cfg.StandbyStatusInterval <= 0 {
+		cfg.StandbyStatusInterval = defaultStandbyStatusInterval
+	}
+
+	master := db.currentTopology().master
+	if master == nil || master.pool == nil {
+		return ErrConnectionFailed
+	}
+
+	if err := db.ensurePublication(ctx, cfg); err != nil {
+		return fmt.Errorf("error creating publication: %w", err)
+	}
+
+	// Подключение в режиме репликации открывается вне пула
+	connConfig := master.pool.Config().ConnConfig.Config.Copy()
+	connConfig.RuntimeParams["replication"] = "database"
+	conn, err := pgconn.ConnectConfig(ctx, connConfig)
+	if err != nil {
+		if db.telemetry != nil {
+			db.telemetry.RecordConnectionError()
+		}
+		return fmt.Errorf("error opening replication connection: %w", err)
+	}
+	defer closeReplicationConn(conn)
+
+	if err := db.ensureReplicationSlot(ctx, conn, cfg); err != nil {
+		return fmt.Errorf("error creating replication slot: %w", err)
+	}
+
+	if err := startReplication(ctx, conn, cfg); err != nil {
+		return fmt.Errorf("error starting replication: %w", err)
+	}
+	db.logger.InfoContext(ctx, "Запущено чтение изменений", "slot", cfg.Slot, "publication", cfg.Publication)
+
+	s := &changeStream{
+		conn:    conn,
+		handler: handler,
+		decoder: newPgoutputDecoder(),
+	}
+	err = s.run(ctx, cfg.StandbyStatusInterval)
+
+	// Сообщаем серверу последнюю подтвержденную позицию перед закрытием подключения
+	if statusErr := s.sendStandbyStatus(); statusErr != nil && err == nil {
+		err = statusErr
+	}
+	if err != nil && ctx.Err() == nil {
+		if db.telemetry != nil {
+			db.telemetry.RecordError()
+		}
+		db.logger.ErrorContext(ctx, "Чтение изменений прервано", "slot", cfg.Slot, "error", err)
+		return fmt.Errorf("change stream error: %w", err)
+	}
+	return ctx.Err()
+}
+
+// ensurePublication создает публикацию на мастере, если ее нет
+func (db *DB) ensurePublication(ctx context.Context, cfg ChangeStreamConfig) error {
+	pool := db.currentTopology().master.pool
+
+	var exists bool
+	err := pool.QueryRow(ctx, "SELECT EXISTS (SELECT 1 FROM pg_publication WHERE pubname = $1)", cfg.Publication).Scan(&exists)
+	if err != nil || exists {
+		return err
+	}
+
+	sql := "CREATE PUBLICATION " + pgx.Identifier{cfg.Publication}.Sanitize()
+	if len(cfg.Tables) == 0 {
+		sql += " FOR ALL TABLES"
+	} else {
+		tables := make([]string, len(cfg.Tables))
+		for i, table := range cfg.Tables {
+			tables[i] = pgx.Identifier(strings.Split(table, ".")).Sanitize()
+		}
+		sql += " FOR TABLE " + strings.Join(tables, ", ")
+	}
+
+	if _, err := pool.Exec(ctx, sql); err != nil {
+		return err
+	}
+	db.logger.InfoContext(ctx, "Создана публикация", "publication", cfg.Publication)
+	return nil
+}
+
+// ensureReplicationSlot создает слот логической репликации, если его нет
+func (db *DB) ensureReplicationSlot(ctx context.Context, conn *pgconn.PgConn, cfg ChangeStreamConfig) error {
+	if !cfg.TemporarySlot {
+		var exists bool
+		err := db.currentTopology().master.pool.QueryRow(ctx,
+			"SELECT EXISTS (SELECT 1 FROM pg_replication_slots WHERE slot_name = $1)", cfg.Slot).Scan(&exists)
+		if err != nil || exists {
+			return err
+		}
+	}
+
+	sql := "CREATE_REPLICATION_SLOT " + pgx.Identifier{cfg.Slot}.Sanitize()
+	if cfg.TemporarySlot {
+		sql += " TEMPORARY"
+	}
+	sql += " LOGICAL pgoutput NOEXPORT_SNAPSHOT"
+
+	if _, err := conn.Exec(ctx, sql).ReadAll(); err != nil {
+		return err
+	}
+	db.logger.InfoContext(ctx, "Создан слот логической репликации", "slot", cfg.Slot)
+	return nil
+}
+
+// startReplication переводит подключение в режим передачи изменений с позиции,
+// подтвержденной в слоте
+func startReplication(ctx context.Context, conn *pgconn.PgConn, cfg ChangeStreamConfig) error {
+	publication := strings.ReplaceAll(pgx.Identifier{cfg.Publication}.Sanitize(), "'", "''")
+	sql := fmt.Sprintf("START_REPLICATION SLOT %s LOGICAL 0/0 (proto_version '1', publication_names '%s')",
+		pgx.Identifier{cfg.Slot}.Sanitize(), publication)
+
+	conn.Frontend().SendQuery(&pgproto3.Query{String: sql})
+	if err := conn.Frontend().Flush(); err != nil {
+		return err
+	}
+
+	for {
+		msg, err := conn.ReceiveMessage(ctx)
+		if err != nil {
+			return err
+		}
+		switch msg := msg.(type) {
+		case *pgproto3.CopyBothResponse:
+			return nil
+		case *pgproto3.ErrorResponse:
+			return pgconn.ErrorResponseToPgError(msg)
+		}
+	}
+}
+
+// closeReplicationConn закрывает подключение репликации, не дожидаясь недоступного сервера дольше listenCloseTimeout
+func closeReplicationConn(conn *pgconn.PgConn) {
+	ctx, cancel := context.WithTimeout(context.Background(), listenCloseTimeout)
+	defer cancel()
+	conn.Close(ctx)
+}
+
+// changeStream состояние чтения изменений из слота
+type changeStream struct {
+	conn    *pgconn.PgConn
+	handler func(context.Context, ChangeEvent) error
+	decoder *pgoutputDecoder
+
+	// acked подтверждаемая серверу позиция: конец последней транзакции, успешно обработанной
+	// handler, или конец WAL, переданного сервером вне транзакции
+	acked LSN
+
+	// inTransaction получено начало транзакции, фиксация которой еще не обработана
+	inTransaction bool
+}
+
+// run принимает сообщения сервера и периодически отправляет подтверждения
+func (s *changeStream) run(ctx context.Context, statusInterval time.Duration) error {
+	nextStatus := time.Now().Add(statusInterval)
+
+	for {
+		if !time.Now().Before(nextStatus) {
+			if err := s.sendStandbyStatus(); err != nil {
+				return err
+			}
+			nextStatus = time.Now().Add(statusInterval)
+		}
+
+		receiveCtx, cancel := context.WithDeadline(ctx, nextStatus)
+		msg, err := s.conn.ReceiveMessage(receiveCtx)
+		cancel()
+		if err != nil {
+			if ctx.Err() == nil && pgconn.Timeout(err) {
+				continue
+			}
+			return err
+		}
+
+		switch msg := msg.(type) {
+		case *pgproto3.CopyData:
+			replyRequested, err := s.handleCopyData(ctx, msg.Data)
+			if err != nil {
+				return err
+			}
+			if replyRequested {
+				nextStatus = time.Time{}
+			}
+		case *pgproto3.ErrorResponse:
+			return pgconn.ErrorResponseToPgError(msg)
+		}
+	}
+}
+
+// handleCopyData обрабатывает сообщение протокола репликации.
+// Возвращает true, если сервер запросил подтверждение
+func (s *changeStream) handleCopyData(ctx context.Context, data []byte) (bool, error) {
+	if len(data) == 0 {
+		return false, nil
+	}
+
+	switch data[0] {
+	case 'k': // Primary keepalive message
+		if len(data) < 18 {
+			return false, errors.New("malformed keepalive message")
+		}
+		// Без подтверждения конца WAL слот удерживал бы WAL при отсутствии изменений
+		// в публикации или при пропуске пустых транзакций
+		s.ackWALEnd(LSN(binary.BigEndian.Uint64(data[1:])))
+		return data[17] == 1, nil
+
+	case 'w': // XLogData
+		if len(data) < 25 {
+			return false, errors.New("malformed XLogData message")
+		}
+		walStart := LSN(binary.BigEndian.Uint64(data[1:]))
+		walEnd := LSN(binary.BigEndian.Uint64(data[9:]))
+
+		event, ok, err := s.decoder.decode(walStart, data[25:])
+		if err != nil {
+			return false, err
+		}
+		if ok {
+			if event.Kind == ChangeBegin {
+				s.inTransaction = true
+			}
+			if err := s.handler(ctx, event); err != nil {
+				return false, err
+			}
+			if event.Kind == ChangeCommit {
+				s.inTransaction = false
+				s.ackLSN(event.LSN)
+			}
+		}
+		s.ackWALEnd(walEnd)
+	}
+
+	return false, nil
+}
+
+// ackWALEnd подтверждает конец WAL, переданного сервером, если транзакция не открыта.
+// Все транзакции, зафиксированные до этой позиции, уже переданы и обработаны
+func (s *changeStream) ackWALEnd(walEnd LSN) {
+	if !s.inTransaction {
+		s.ackLSN(walEnd)
+	}
+}
+
+// ackLSN сдвигает подтверждаемую позицию вперед
+func (s *changeStream) ackLSN(lsn LSN) {
+	if lsn > s.acked {
+		s.acked = lsn
+	}
+}
+
+// sendStandbyStatus подтверждает серверу позицию acked
+func (s *changeStream) sendStandbyStatus() error {
+	buf := make([]byte, 0, 34)
+	buf = append(buf, 'r')
+	buf = binary.BigEndian.AppendUint64(buf, uint64(s.acked)) // записано
+	buf = binary.BigEndian.AppendUint64(buf, uint64(s.acked)) // сброшено на диск
+	buf = binary.BigEndian.AppendUint64(buf, uint64(s.acked)) // применено
+	buf = binary.BigEndian.AppendUint64(buf, uint64(time.Since(pgEpoch).Microseconds()))
+	buf = append(buf, 0)
+
+	s.conn.Frontend().Send(&pgproto3.CopyData{Data: buf})
+	return s.conn.Frontend().Flush()
+}
+
+// relation описание таблицы из сообщения Relation протокола pgoutput
+type relation struct {
+	schema  string
+	table   string
+	columns []relationColumn
+}
+
+// relationColumn столбец таблицы
+type relationColumn struct {
+	name string
+	oid  uint32
+}
+
+// pgoutputDecoder разбирает сообщения протокола pgoutput версии 1
+type pgoutputDecoder struct {
+	relations map[uint32]*relation
+	typeMap   *pgtype.Map
+
+	// xid и commitTime текущей транзакции
+	xid        uint32
+	commitTime time.Time
+}
+
+// newPgoutputDecoder создает декодер сообщений pgoutput
+func newPgoutputDecoder() *pgoutputDecoder {
+	return &pgoutputDecoder{
+		relations: make(map[uint32]*relation),
+		typeMap:   pgtype.NewMap(),
+	}
+}
+
+// decode разбирает сообщение pgoutput. Возвращает false для служебных сообщений,
+// которые не порождают событие (Relation, Type, Origin, Truncate, Message)
+func (d *pgoutputDecoder) decode(walStart LSN, data []byte) (ChangeEvent, bool, error) {
+	if len(data) == 0 {
+		return ChangeEvent{}, false, errors.New("empty pgoutput message")
+	}
+	r := &messageReader{data: data[1:]}
+
+	switch data[0] {
+	case 'B':
+		finalLSN := LSN(r.uint64())
+		d.commitTime = pgTime(r.uint64())
+		d.xid = r.uint32()
+		return ChangeEvent{Kind: ChangeBegin, LSN: finalLSN, XID: d.xid, CommitTime: d.commitTime}, true, r.err
+
+	case 'C':
+		r.byte()   // флаги
+		r.uint64() // позиция фиксации
+		endLSN := LSN(r.uint64())
+		commitTime := pgTime(r.uint64())
+		return ChangeEvent{Kind: ChangeCommit, LSN: endLSN, XID: d.xid, CommitTime: commitTime}, true, r.err
+
+	case 'R':
+		id := r.uint32()
+		rel := &relation{schema: r.string(), table: r.string()}
+		r.byte() // REPLICA IDENTITY
+		n := int(r.uint16())
+		for i := 0; i < n && r.err == nil; i++ {
+			r.byte() // флаги столбца
+			name := r.string()
+			oid := r.uint32()
+			r.uint32() // модификатор типа
+			rel.columns = append(rel.columns, relationColumn{name: name, oid: oid})
+		}
+		if r.err == nil {
+			d.relations[id] = rel
+		}
+		return ChangeEvent{}, false, r.err
+
+	case 'I', 'U', 'D':
+		return d.decodeRowChange(data[0], walStart, r)
+	}
+
+	return ChangeEvent{}, false, nil
+}
+
+// decodeRowChange разбирает сообщения Insert, Update и Delete
+func (d *pgoutputDecoder) decodeRowChange(kind byte, walStart LSN, r *messageReader) (ChangeEvent, bool, error) {
+	id := r.uint32()
+	rel, ok := d.relations[id]
+	if !ok && r.err == nil {
+		return ChangeEvent{}, false, fmt.Errorf("unknown relation %d in pgoutput message", id)
+	}
+
+	event := ChangeEvent{LSN: walStart, XID: d.xid, CommitTime: d.commitTime}
+	if rel != nil {
+		event.Schema, event.Table = rel.schema, rel.table
+	}
+
+	switch kind {
+	case 'I':
+		event.Kind = ChangeInsert
+	case 'U':
+		event.Kind = ChangeUpdate
+	case 'D':
+		event.Kind = ChangeDelete
+	}
+
+	for r.err == nil && len(r.data) > 0 {
+		tupleType := r.byte()
+		tuple, err := d.decodeTuple(rel, r)
+		if err != nil {
+			return ChangeEvent{}, false, err
+		}
+		switch tupleType {
+		case 'K', 'O':
+			event.Old = tuple
+		case 'N':
+			event.New = tuple
+		default:
+			return ChangeEvent{}, false, fmt.Errorf("unexpected tuple type %q in pgoutput message", tupleType)
+		}
+	}
+
+	return event, true, r.err
+}
+
+// decodeTuple разбирает значения столбцов строки в типы Go по OID столбцов
+func (d *pgoutputDecoder) decodeTuple(rel *relation, r *messageReader) (map[string]any, error) {
+	n := int(r.uint16())
+	if r.err == nil && n > len(rel.columns) {
+		return nil, fmt.Errorf("tuple has %d columns, relation %s.%s has %d", n, rel.schema, rel.table, len(rel.columns))
+	}
+
+	values := make(map[string]any, n)
+	for i := 0; i < n && r.err == nil; i++ {
+		column := rel.columns[i]
+		switch r.byte() {
+		case 'n': // NULL
+			values[column.name] = nil
+		case 'u': // неизмененное TOAST-значение не передается
+		case 't':
+			size := int(r.uint32())
+			raw := r.bytes(size)
+			if r.err != nil {
+				break
+			}
+			value, err := d.decodeValue(column.oid, raw)
+			if err != nil {
+				return nil, fmt.Errorf("error decoding column %s: %w", column.name, err)
+			}
+			values[column.name] = value
+		default:
+			return nil, fmt.Errorf("unexpected column format in pgoutput message")
+		}
+	}
+
+	return values, r.err
+}
+
+// decodeValue преобразует текстовое представление значения в тип Go.
+// Значения неизвестных типов возвращаются строкой
+func (d *pgoutputDecoder) decodeValue(oid uint32, raw []byte) (any, error) {
+	if dt, ok := d.typeMap.TypeForOID(oid); ok {
+		return dt.Codec.DecodeValue(d.typeMap, oid, pgtype.TextFormatCode, raw)
+	}
+	return string(raw), nil
+}
+
+// pgTime преобразует время протокола репликации (микросекунды с 2000-01-01) в time.Time
+func pgTime(microseconds uint64) time.Time {
+	return pgEpoch.Add(time.Duration(int64(microseconds)) * time.Microsecond)
+}
+
+// messageReader последовательно читает поля сообщения протокола.
+// После первой ошибки все методы возвращают нулевые значения, ошибка хранится в err
+type messageReader struct {
+	data []byte
+	err  error
+}
+
+// bytes читает n байт
+func (r *messageReader) bytes(n int) []byte {
+	if r.err != nil {
+		return nil
+	}
+	if n < 0 || len(r.data) < n {
+		r.err = errors.New("truncated pgoutput message")
+		return nil
+	}
+	b := r.data[:n]
+	r.data = r.data[n:]
+	return b
+}
+
+// byte читает один байт
+func (r *messageReader) byte() byte {
+	if b := r.bytes(1); b != nil {
+		return b[0]
+	}
+	return 0
+}
+
+// uint16 читает целое длиной 2 байта
+func (r *messageReader) uint16() uint16 {
+	if b := r.bytes(2); b != nil {
+		return binary.BigEndian.Uint16(b)
+	}
+	return 0
+}
+
+// uint32 читает целое длиной 4 байта
+func (r *messageReader) uint32() uint32 {
+	if b := r.bytes(4); b != nil {
+		return binary.BigEndian.Uint32(b)
+	}
+	return 0
+}
+
+// uint64 читает целое длиной 8 байт
+func (r *messageReader) uint64() uint64 {
+	if b := r.bytes(8); b != nil {
+		return binary.BigEndian.Uint64(b)
+	}
+	return 0
+}
+
+// string читает строку, завершенную нулевым байтом
+func (r *messageReader) string() string {
+	if r.err != nil {
+		return ""
+	}
+	i := bytes.IndexByte(r.data, 0)
+	if i < 0 {
+		r.err = errors.New("truncated pgoutput message")
+		return ""
+	}
+	s := string(r.data[:i])
+	r.data = r.data[i+1:]
+	return s
+}
@@ -0,0 +1,158 @@
+package pgxwrapper
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"syscall"
+
+	"github.com/jackc/pgx/v5/pgconn"
+)
+
+// ErrorClass класс ошибки, определяющий, можно ли повторить операцию
+type ErrorClass int
+
+const (
+	// ErrorClassNone ошибки нет
+	ErrorClassNone ErrorClass = iota
+
+	// ErrorClassPermanent ошибка, которую не исправит повторная попытка
+	// (синтаксис, ограничения целостности, права доступа и т.п.)
+	ErrorClassPermanent
+
+	// ErrorClassConnection ошибка сети или подключения (SQLSTATE класса 08)
+	ErrorClassConnection
+
+	// ErrorClassTimeout истек таймаут операции (QueryTimeout или дедлайн контекста).
+	// Не повторяется: запрос, не уложившийся в таймаут, скорее всего не уложится и на другом узле,
+	// а повтор на всех репликах и мастере умножил бы нагрузку. Таймауты установки подключения
+	// относятся к ErrorClassConnection
+	ErrorClassTimeout
+
+	// ErrorClassShutdown сервер останавливается или запускается (57P01, 57P02, 57P03)
+	ErrorClassShutdown
+
+	// ErrorClassSerialization ошибка сериализации или взаимоблокировка (40001, 40P01)
+	ErrorClassSerialization
+
+	// ErrorClassTooManyConnections превышено количество подключений к серверу (53300)
+	ErrorClassTooManyConnections
+)
+
+// String возвращает название класса ошибки
+func (c ErrorClass) String() string {
+	switch c {
+	case ErrorClassNone:
+		return "none"
+	case ErrorClassPermanent:
+		return "permanent"
+	case ErrorClassConnection:
+		return "connection"
+	case ErrorClassTimeout:
+		return "timeout"
+	case ErrorClassShutdown:
+		return "shutdown"
+	case ErrorClassSerialization:
+		return "serialization"
+	case ErrorClassTooManyConnections:
+		return "too_many_connections"
+	default:
+		return "unknown"
+	}
+}
+
+// Retryable проверяет, имеет ли смысл повторить операцию, в том числе на другом узле
+func (c ErrorClass) Retryable() bool {
+	switch c {
+	case ErrorClassConnection,
+		ErrorClassShutdown,
+		ErrorClassSerialization,
+		ErrorClassTooManyConnections:
+		return true
+	default:
+		return false
+	}
+}
+
+// NodeFailure проверяет, указывает ли ошибка на недоступность узла
+func (c ErrorClass) NodeFailure() bool {
+	return c == ErrorClassConnection || c == ErrorClassShutdown
+}
+
+// ClassifyError определяет класс ошибки по SQLSTATE PostgreSQL и типу ошибки Go
+func ClassifyError(err error) ErrorClass {
+	if err == nil {
+		return ErrorClassNone
+	}
+
+	var pgErr *pgconn.PgError
+	if errors.As(err, &pgErr) {
+		switch {
+		case strings.HasPrefix(pgErr.Code, "08"): // SQLSTATE connection_exception
+			return ErrorClassConnection
+		case pgErr.Code == "57P01", // SQLSTATE admin_shutdown
+			pgErr.Code == "57P02", // SQLSTATE crash_shutdown
+			pgErr.Code == "57P03": // SQLSTATE cannot_connect_now
+			return ErrorClassShutdown
+		case pgErr.Code == "40001", // SQLSTATE serialization_failure
+			pgErr.Code == "40P01": // SQLSTATE deadlock_detected
+			return ErrorClassSerialization
+		case pgErr.Code == "53300": // SQLSTATE too_many_connections
+			return ErrorClassTooManyConnections
+		}
+
+		// Ошибка сервера при установке подключения (например, аутентификация) не исправится повтором
+		return ErrorClassPermanent
+	}
+
+	// Таймаут установки подключения означает недоступность узла, а не долгий запрос
+	var connectErr *pgconn.ConnectError
+	var opErr *net.OpError
+	if errors.As(err, &connectErr) || (errors.As(err, &opErr) && opErr.Op == "dial") {
+		return ErrorClassConnection
+	}
+
+	if pgconn.Timeout(err) || errors.Is(err, context.DeadlineExceeded) {
+		return ErrorClassTimeout
+	}
+
+	if errors.Is(err, context.Canceled) {
+		return ErrorClassPermanent
+	}
+
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return ErrorClassTimeout
+	}
+
+	if errors.As(err, &opErr) ||
+		errors.Is(err, io.EOF) ||
+		errors.Is(err, io.ErrUnexpectedEOF) ||
+		errors.Is(err, net.ErrClosed) ||
+		errors.Is(err, syscall.ECONNREFUSED) ||
+		errors.Is(err, syscall.ECONNRESET) ||
+		errors.Is(err, syscall.EPIPE) ||
+		pgconn.SafeToRetry(err) {
+		return ErrorClassConnection
+	}
+
+	return ErrorClassPermanent
+}
+
+// classifyError определяет класс ошибки с помощью Config.ErrorClassifier или ClassifyError
+func (db *DB) classifyError(err error) ErrorClass {
+	if err == nil {
+		return ErrorClassNone
+	}
+	// Часть данных COPY TO уже передана получателю, повтор продублировал бы ее
+	var partial *partialCopyError
+	if errors.As(err, &partial) {
+		return ErrorClassPermanent
+	}
+	if db.config.ErrorClassifier != nil {
+		return db.config.ErrorClassifier(err)
+	}
+	return ClassifyError(err)
+}
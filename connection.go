@@ -3,20 +3,86 @@ package pgxwrapper
 import (
 	"context"
 	"fmt"
-	"time"
 
 	"github.com/jackc/pgx/v5"
 	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/jackc/pgx/v5/pgxpool"
 )
 
-// masterConn структура для подключения к мастеру
+// masterConn структура для подключения к мастеру.
+// Каждая операция берет подключение из пула и возвращает его после завершения,
+// поэтому masterConn безопасен для конкурентного использования
 type masterConn struct {
-	conn *pgx.Conn
+	conn *pgxpool.Pool
 	db   *DB
+
+	// role роль узла в метках метрик: master, sync или async
+	role string
+
+	// name имя узла для перехватчиков
+	name string
+
+	// position положение операции в повторных попытках ReplicaManager для трассировки
+	position fallbackPosition
+
+	// slot учет операции в количестве выполняющихся на узле, см. inFlightSlot
+	slot *inFlightSlot
+
+	// reconnect повторять операции при потере подключения, см. DB.withReconnect
+	reconnect bool
+
+	// failover искать новый мастер, если узел перешел в режим только для чтения
+	failover bool
+
+	// ambient выполнять операции во внешней транзакции из контекста (WithTx), если она есть
+	ambient bool
+}
+
+// ambientTx возвращает транзакцию из контекста, в которой должна выполняться операция
+func (mc *masterConn) ambientTx(ctx context.Context) (Tx, bool) {
+	if !mc.ambient {
+		return nil, false
+	}
+	return TxFromContext(ctx)
+}
+
+// captureCommitLSN запоминает позицию WAL после успешной операции на мастере,
+// если включен Config.CaptureCommitLSN. Операции на репликах позицию не меняют
+func (mc *masterConn) captureCommitLSN(ctx context.Context) {
+	if mc.role == roleMaster {
+		mc.db.captureCommitLSN(ctx)
+	}
+}
+
+// withReconnect выполняет операцию с повторными попытками при потере подключения,
+// если они включены для этого подключения. Если запись отклонена, потому что мастер
+// стал репликой, роли узлов перепроверяются и операция повторяется на новом мастере
+func (mc *masterConn) withReconnect(ctx context.Context, operation func(pool *pgxpool.Pool) error) error {
+	run := func(pool *pgxpool.Pool) error {
+		if !mc.reconnect {
+			return operation(pool)
+		}
+		return mc.db.withReconnect(ctx, func() error {
+			return operation(pool)
+		})
+	}
+
+	err := run(mc.conn)
+	if mc.failover && isReadOnlyError(err) {
+		if master, changed := mc.db.failoverMaster(ctx, mc.conn); changed {
+			mc.db.logger.InfoContext(ctx, "Операция повторяется на новом мастере", "master", master.name)
+			return run(master.pool)
+		}
+	}
+	return err
 }
 
-// Exec выполняет SQL команду на мастере
+// Exec выполняет SQL команду на мастере или во внешней транзакции из контекста
 func (mc *masterConn) Exec(ctx context.Context, sql string, arguments ...any) (pgconn.CommandTag, error) {
+	if tx, ok := mc.ambientTx(ctx); ok {
+		return tx.Exec(ctx, sql, arguments...)
+	}
+
 	// Применяем таймаут из конфигурации, если он задан
 	if mc.db.config.QueryTimeout > 0 {
 		var cancel func()
@@ -24,15 +90,18 @@ func (mc *masterConn) Exec(ctx context.Context, sql string, arguments ...any) (p
 		defer cancel()
 	}
 
-	if mc.db.telemetry != nil && mc.db.telemetry.IsEnabled() {
-		start := time.Now()
-		defer func() {
-			duration := time.Since(start)
-			mc.db.telemetry.RecordQuery(duration)
-		}()
+	ctx, op, err := mc.startOperation(ctx, OperationExec, sql, arguments)
+	if err != nil {
+		return pgconn.CommandTag{}, err
 	}
 
-	result, err := mc.conn.Exec(ctx, sql, arguments...)
+	var result pgconn.CommandTag
+	err = mc.withReconnect(ctx, func(pool *pgxpool.Pool) (err error) {
+		result, err = pool.Exec(ctx, op.SQL, op.Args...)
+		return err
+	})
+	op.setResult(result)
+	op.end(err)
 	if err != nil {
 		if mc.db.telemetry != nil {
 			mc.db.telemetry.RecordError()
@@ -42,28 +111,37 @@ func (mc *masterConn) Exec(ctx context.Context, sql string, arguments ...any) (p
 	}
 
 	mc.db.logger.DebugContext(ctx, "Выполнен Exec на мастере", "sql", sql)
+	mc.captureCommitLSN(ctx)
 	return result, nil
 }
 
-// Query выполняет SQL запрос на мастере
+// Query выполняет SQL запрос на мастере или во внешней транзакции из контекста
 func (mc *masterConn) Query(ctx context.Context, sql string, args ...any) (Rows, error) {
-	// Применяем таймаут из конфигурации, если он задан
+	if tx, ok := mc.ambientTx(ctx); ok {
+		return tx.Query(ctx, sql, args...)
+	}
+
+	// Применяем таймаут из конфигурации, если он задан.
+	// Таймаут действует до закрытия Rows, так как строки читаются после возврата из Query
+	cancel := func() {}
 	if mc.db.config.QueryTimeout > 0 {
-		var cancel func()
 		ctx, cancel = context.WithTimeout(ctx, mc.db.config.QueryTimeout)
-		defer cancel()
 	}
 
-	if mc.db.telemetry != nil && mc.db.telemetry.IsEnabled() {
-		start := time.Now()
-		defer func() {
-			duration := time.Since(start)
-			mc.db.telemetry.RecordQuery(duration)
-		}()
+	ctx, op, err := mc.startOperation(ctx, OperationQuery, sql, args)
+	if err != nil {
+		cancel()
+		return nil, err
 	}
 
-	rows, err := mc.conn.Query(ctx, sql, args...)
+	var rows pgx.Rows
+	err = mc.withReconnect(ctx, func(pool *pgxpool.Pool) (err error) {
+		rows, err = pool.Query(ctx, op.SQL, op.Args...)
+		return err
+	})
 	if err != nil {
+		op.end(err)
+		cancel()
 		if mc.db.telemetry != nil {
 			mc.db.telemetry.RecordError()
 		}
@@ -72,32 +150,61 @@ func (mc *masterConn) Query(ctx context.Context, sql string, args ...any) (Rows,
 	}
 
 	mc.db.logger.DebugContext(ctx, "Выполнен Query на мастере", "sql", sql)
-	return &rowsWrapper{rows: rows}, nil
+
+	// Запрос может изменять данные (INSERT ... RETURNING), поэтому позиция WAL
+	// запоминается после чтения всех строк без ошибки
+	release := mc.slot.hold()
+	done := func(tag pgconn.CommandTag, err error) {
+		release()
+		op.endRows(tag, err)
+		if err == nil {
+			mc.captureCommitLSN(ctx)
+		}
+	}
+	return &rowsWrapper{rows: rows, cancel: cancel, done: done}, nil
 }
 
-// QueryRow выполняет SQL запрос и возвращает одну строку на мастере
+// QueryRow выполняет SQL запрос и возвращает одну строку на мастере или во внешней транзакции из контекста
 func (mc *masterConn) QueryRow(ctx context.Context, sql string, args ...any) Row {
-	// Применяем таймаут из конфигурации, если он задан
+	if tx, ok := mc.ambientTx(ctx); ok {
+		return tx.QueryRow(ctx, sql, args...)
+	}
+
+	if mc.failover || (mc.reconnect && mc.db.config.ReconnectTimeout > 0) {
+		return &reconnectingRow{ctx: ctx, mc: mc, sql: sql, args: args, release: mc.slot.hold()}
+	}
+
+	// Применяем таймаут из конфигурации, если он задан. Таймаут действует до вызова Scan
+	cancel := func() {}
 	if mc.db.config.QueryTimeout > 0 {
-		var cancel func()
 		ctx, cancel = context.WithTimeout(ctx, mc.db.config.QueryTimeout)
-		defer cancel()
 	}
 
-	if mc.db.telemetry != nil && mc.db.telemetry.IsEnabled() {
-		start := time.Now()
-		defer func() {
-			duration := time.Since(start)
-			mc.db.telemetry.RecordQuery(duration)
-		}()
+	ctx, op, err := mc.startOperation(ctx, OperationQueryRow, sql, args)
+	if err != nil {
+		cancel()
+		return errRow{err: err}
 	}
 
-	row := mc.conn.QueryRow(ctx, sql, args...)
-	return &rowWrapper{row: row}
+	row := mc.conn.QueryRow(ctx, op.SQL, op.Args...)
+	release := mc.slot.hold()
+	done := func(err error) {
+		release()
+		op.end(err)
+		if err == nil {
+			mc.captureCommitLSN(ctx)
+		}
+	}
+	return &rowWrapper{row: row, cancel: cancel, done: done}
 }
 
-// Begin начинает транзакцию на мастере
+// Begin начинает транзакцию на мастере. Если в контексте есть внешняя транзакция,
+// создается вложенная транзакция на ее точке сохранения
 func (mc *masterConn) Begin(ctx context.Context) (Tx, error) {
+	if tx, ok := mc.ambientTx(ctx); ok {
+		return tx.Begin(ctx)
+	}
+
 	// Применяем таймаут из конфигурации, если он задан
 	if mc.db.config.QueryTimeout > 0 {
 		var cancel func()
@@ -105,15 +212,17 @@ func (mc *masterConn) Begin(ctx context.Context) (Tx, error) {
 		defer cancel()
 	}
 
-	if mc.db.telemetry != nil && mc.db.telemetry.IsEnabled() {
-		start := time.Now()
-		defer func() {
-			duration := time.Since(start)
-			mc.db.telemetry.RecordQuery(duration)
-		}()
+	ctx, op, err := mc.startOperation(ctx, OperationBegin, "", nil)
+	if err != nil {
+		return nil, err
 	}
 
-	tx, err := mc.conn.Begin(ctx)
+	var tx pgx.Tx
+	err = mc.withReconnect(ctx, func(pool *pgxpool.Pool) (err error) {
+		tx, err = pool.Begin(ctx)
+		return err
+	})
+	op.end(err)
 	if err != nil {
 		if mc.db.telemetry != nil {
 			mc.db.telemetry.RecordError()
@@ -122,13 +231,20 @@ func (mc *masterConn) Begin(ctx context.Context) (Tx, error) {
 	}
 
 	return &txWrapper{
-		tx: tx,
-		db: mc.db,
+		tx:   tx,
+		db:   mc.db,
+		role: mc.role,
+		node: mc.name,
 	}, nil
 }
 
-// BeginTx начинает транзакцию с опциями на мастере
+// BeginTx начинает транзакцию с опциями на мастере. Если в контексте есть внешняя транзакция,
+// создается вложенная транзакция на ее точке сохранения
 func (mc *masterConn) BeginTx(ctx context.Context, txOptions TxOptions) (Tx, error) {
+	if tx, ok := mc.ambientTx(ctx); ok {
+		return tx.BeginTx(ctx, txOptions)
+	}
+
 	// Применяем таймаут из конфигурации, если он задан
 	if mc.db.config.QueryTimeout > 0 {
 		var cancel func()
@@ -136,15 +252,17 @@ func (mc *masterConn) BeginTx(ctx context.Context, txOptions TxOptions) (Tx, err
 		defer cancel()
 	}
 
-	if mc.db.telemetry != nil && mc.db.telemetry.IsEnabled() {
-		start := time.Now()
-		defer func() {
-			duration := time.Since(start)
-			mc.db.telemetry.RecordQuery(duration)
-		}()
+	ctx, op, err := mc.startOperation(ctx, OperationBegin, "", nil)
+	if err != nil {
+		return nil, err
 	}
 
-	tx, err := mc.conn.BeginTx(ctx, txOptions.TxOptions)
+	var tx pgx.Tx
+	err = mc.withReconnect(ctx, func(pool *pgxpool.Pool) (err error) {
+		tx, err = pool.BeginTx(ctx, txOptions.TxOptions)
+		return err
+	})
+	op.end(err)
 	if err != nil {
 		if mc.db.telemetry != nil {
 			mc.db.telemetry.RecordError()
@@ -153,8 +271,12 @@ func (mc *masterConn) BeginTx(ctx context.Context, txOptions TxOptions) (Tx, err
 	}
 
 	return &txWrapper{
-		tx: tx,
-		db: mc.db,
+		tx:       tx,
+		db:       mc.db,
+		role:     mc.role,
+		node:     mc.name,
+		readOnly: txOptions.AccessMode == pgx.ReadOnly,
+		options:  txOptions.TxOptions,
 	}, nil
 }
 
@@ -167,7 +289,9 @@ func (mc *masterConn) Ping(ctx context.Context) error {
 		defer cancel()
 	}
 
-	err := mc.conn.Ping(ctx)
+	err := mc.withReconnect(ctx, func(pool *pgxpool.Pool) error {
+		return pool.Ping(ctx)
+	})
 	if err != nil {
 		if mc.db.telemetry != nil {
 			mc.db.telemetry.RecordConnectionError()
@@ -178,9 +302,10 @@ func (mc *masterConn) Ping(ctx context.Context) error {
 	return nil
 }
 
-// Close закрывает соединение с мастером
+// Close закрывает пул подключений к мастеру
 func (mc *masterConn) Close(ctx context.Context) error {
-	return mc.conn.Close(ctx)
+	mc.conn.Close()
+	return nil
 }
 
 // replicaConn структура для подключения к реплике
@@ -196,23 +321,29 @@ func (rc *replicaConn) Exec(ctx context.Context, sql string, arguments ...any) (
 
 // QueryRow выполняет SQL запрос и возвращает одну строку на реплике
 func (rc *replicaConn) QueryRow(ctx context.Context, sql string, args ...any) Row {
-	// Применяем таймаут из конфигурации, если он задан
+	if rc.reconnect && rc.db.config.ReconnectTimeout > 0 {
+		return &reconnectingRow{ctx: ctx, mc: &rc.masterConn, sql: sql, args: args, release: rc.slot.hold()}
+	}
+
+	// Применяем таймаут из конфигурации, если он задан. Таймаут действует до вызова Scan
+	cancel := func() {}
 	if rc.db.config.QueryTimeout > 0 {
-		var cancel func()
 		ctx, cancel = context.WithTimeout(ctx, rc.db.config.QueryTimeout)
-		defer cancel()
 	}
 
-	if rc.db.telemetry != nil && rc.db.telemetry.IsEnabled() {
-		start := time.Now()
-		defer func() {
-			duration := time.Since(start)
-			rc.db.telemetry.RecordQuery(duration)
-		}()
+	ctx, op, err := rc.startOperation(ctx, OperationQueryRow, sql, args)
+	if err != nil {
+		cancel()
+		return errRow{err: err}
 	}
 
-	row := rc.conn.QueryRow(ctx, sql, args...)
-	return &rowWrapper{row: row}
+	row := rc.conn.QueryRow(ctx, op.SQL, op.Args...)
+	release := rc.slot.hold()
+	done := func(err error) {
+		release()
+		op.end(err)
+	}
+	return &rowWrapper{row: row, cancel: cancel, done: done}
 }
 
 // Begin начинает транзакцию на реплике (не поддерживается)
@@ -223,10 +354,47 @@ func (rc *replicaConn) Begin(ctx context.Context) (Tx, error) {
 	return nil, ErrMasterOnlyOperation
 }
 
-// BeginTx начинает транзакцию с опциями на реплике (не поддерживается)
+// BeginTx начинает транзакцию на реплике. Поддерживаются только транзакции
+// только для чтения (AccessMode: pgx.ReadOnly), остальные возвращают ErrMasterOnlyOperation
 func (rc *replicaConn) BeginTx(ctx context.Context, txOptions TxOptions) (Tx, error) {
-	if rc.db.telemetry != nil {
-		rc.db.telemetry.RecordError()
+	if txOptions.AccessMode != pgx.ReadOnly {
+		if rc.db.telemetry != nil {
+			rc.db.telemetry.RecordError()
+		}
+		return nil, ErrMasterOnlyOperation
 	}
-	return nil, ErrMasterOnlyOperation
+
+	// Применяем таймаут из конфигурации, если он задан
+	if rc.db.config.QueryTimeout > 0 {
+		var cancel func()
+		ctx, cancel = context.WithTimeout(ctx, rc.db.config.QueryTimeout)
+		defer cancel()
+	}
+
+	ctx, op, err := rc.startOperation(ctx, OperationBegin, "", nil)
+	if err != nil {
+		return nil, err
+	}
+
+	var tx pgx.Tx
+	err = rc.withReconnect(ctx, func(pool *pgxpool.Pool) (err error) {
+		tx, err = pool.BeginTx(ctx, txOptions.TxOptions)
+		return err
+	})
+	op.end(err)
+	if err != nil {
+		if rc.db.telemetry != nil {
+			rc.db.telemetry.RecordError()
+		}
+		return nil, fmt.Errorf("error starting read-only transaction on replica: %w", err)
+	}
+
+	return &txWrapper{
+		tx:       tx,
+		db:       rc.db,
+		role:     rc.role,
+		node:     rc.name,
+		readOnly: true,
+		options:  txOptions.TxOptions,
+	}, nil
 }
@@ -0,0 +1,139 @@
+package pgxwrapper
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+const (
+	// readYourWritesPollInterval интервал опроса реплик при ожидании применения LSN
+	readYourWritesPollInterval = 10 * time.Millisecond
+
+	// readYourWritesMinProbeTimeout минимальное время на запрос позиции WAL у реплики,
+	// чтобы реплика опрашивалась и при нулевом Config.ReadYourWritesTimeout
+	readYourWritesMinProbeTimeout = 50 * time.Millisecond
+)
+
+// lsnContextKey ключ контекста для LSN, которую должна применить реплика
+type lsnContextKey struct{}
+
+// WithLSN возвращает контекст, запросы на чтение с которым будут выполняться
+// только на репликах, применивших WAL до позиции lsn
+func WithLSN(ctx context.Context, lsn LSN) context.Context {
+	if current, ok := LSNFromContext(ctx); ok && current >= lsn {
+		return ctx
+	}
+	return context.WithValue(ctx, lsnContextKey{}, lsn)
+}
+
+// LSNFromContext возвращает LSN, сохраненную в контексте функцией WithLSN
+func LSNFromContext(ctx context.Context) (LSN, bool) {
+	lsn, ok := ctx.Value(lsnContextKey{}).(LSN)
+	return lsn, ok
+}
+
+// LastCommitLSN возвращает наибольшую позицию WAL мастера, полученную после фиксации изменений.
+// Позиция обновляется автоматически, если включен Config.CaptureCommitLSN, и при вызове CurrentLSN
+func (db *DB) LastCommitLSN() LSN {
+	return LSN(db.lastCommitLSN.Load())
+}
+
+// CurrentLSN запрашивает текущую позицию WAL на мастере и запоминает ее как LastCommitLSN
+func (db *DB) CurrentLSN(ctx context.Context) (LSN, error) {
+	var text string
+	if err := db.currentTopology().master.pool.QueryRow(ctx, "SELECT pg_current_wal_lsn()::text").Scan(&text); err != nil {
+		return 0, fmt.Errorf("error getting current WAL position on master: %w", err)
+	}
+
+	lsn, err := ParseLSN(text)
+	if err != nil {
+		return 0, err
+	}
+
+	db.advanceCommitLSN(lsn)
+	return lsn, nil
+}
+
+// advanceCommitLSN увеличивает LastCommitLSN до lsn
+func (db *DB) advanceCommitLSN(lsn LSN) {
+	for {
+		current := db.lastCommitLSN.Load()
+		if uint64(lsn) <= current || db.lastCommitLSN.CompareAndSwap(current, uint64(lsn)) {
+			return
+		}
+	}
+}
+
+// captureCommitLSN запоминает позицию WAL мастера после фиксации изменений,
+// если включен Config.CaptureCommitLSN
+func (db *DB) captureCommitLSN(ctx context.Context) {
+	if !db.config.CaptureCommitLSN {
+		return
+	}
+
+	if _, err := db.CurrentLSN(ctx); err != nil {
+		db.logger.WarnContext(ctx, "Не удалось получить позицию WAL после фиксации", "error", err)
+	}
+}
+
+// replicaReachedLSN проверяет, применила ли реплика WAL до позиции lsn.
+// Сначала используется последнее известное значение, затем позиция запрашивается у реплики;
+// запрос ограничен сроком deadline, чтобы зависшая реплика не задерживала чтение
+func (db *DB) replicaReachedLSN(ctx context.Context, n *node, lsn LSN, deadline time.Time) bool {
+	if n.isMaster || n.getReplicationState().replayLSN >= lsn {
+		return true
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, max(time.Until(deadline), readYourWritesMinProbeTimeout))
+	defer cancel()
+
+	var text *string
+	if err := n.pool.QueryRow(ctx, "SELECT pg_last_wal_replay_lsn()::text").Scan(&text); err != nil || text == nil {
+		return false
+	}
+
+	replayLSN, err := ParseLSN(*text)
+	if err != nil {
+		return false
+	}
+
+	n.advanceReplayLSN(replayLSN)
+	return replayLSN >= lsn
+}
+
+// nodesReachedLSN оставляет из nodes только узлы, применившие WAL до позиции lsn.
+// Реплики, которые не примут запрос из-за отставания или разомкнутого автоматического
+// выключателя, не опрашиваются. Если ни одна реплика еще не применила lsn, ожидает
+// до Config.ReadYourWritesTimeout; мастер всегда остается в списке, поэтому
+// по истечении ожидания чтение выполняется на нем
+func (db *DB) nodesReachedLSN(ctx context.Context, nodes []*node, lsn LSN) ([]*node, error) {
+	deadline := time.Now().Add(db.config.ReadYourWritesTimeout)
+
+	var probed []*node
+	for _, n := range nodes {
+		if _, exceeded := db.replicationLagExceeded(n); exceeded || db.nodeUnavailable(n) {
+			continue
+		}
+		probed = append(probed, n)
+	}
+
+	for {
+		var ready []*node
+		replicaReady := false
+		for _, n := range probed {
+			if db.replicaReachedLSN(ctx, n, lsn, deadline) {
+				ready = append(ready, n)
+				replicaReady = replicaReady || !n.isMaster
+			}
+		}
+
+		if replicaReady || !time.Now().Before(deadline) {
+			return ready, nil
+		}
+
+		if err := sleepContext(ctx, readYourWritesPollInterval); err != nil {
+			return nil, err
+		}
+	}
+}
@@ -0,0 +1,371 @@
+package pgxwrapper
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/jackc/pgx/v5/pgtype"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// copyBufferSize размер порции данных COPY FROM, передаваемой серверу за одну запись
+const copyBufferSize = 65536 - 5
+
+// countingWriter считает байты, переданные получателю COPY TO
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+// Write передает данные получателю и увеличивает счетчик байт
+func (cw *countingWriter) Write(p []byte) (int, error) {
+	n, err := cw.w.Write(p)
+	cw.n += int64(n)
+	return n, err
+}
+
+// countingReader считает байты, прочитанные из источника COPY FROM
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+// Read читает данные из источника и увеличивает счетчик байт
+func (cr *countingReader) Read(p []byte) (int, error) {
+	n, err := cr.r.Read(p)
+	cr.n += int64(n)
+	return n, err
+}
+
+// partialCopyError ошибка COPY TO после того, как часть данных уже передана получателю.
+// Повтор такой операции на другом узле продублировал бы данные, поэтому она не повторяется
+type partialCopyError struct {
+	err   error
+	bytes int64
+}
+
+// Error возвращает описание ошибки
+func (e *partialCopyError) Error() string {
+	return fmt.Sprintf("copy interrupted after %d bytes: %v", e.bytes, e.err)
+}
+
+// Unwrap возвращает исходную ошибку
+func (e *partialCopyError) Unwrap() error {
+	return e.err
+}
+
+// quoteColumns возвращает имена столбцов через запятую в кавычках
+func quoteColumns(columnNames []string) string {
+	columns := make([]string, len(columnNames))
+	for i, name := range columnNames {
+		columns[i] = pgx.Identifier{name}.Sanitize()
+	}
+	return strings.Join(columns, ", ")
+}
+
+// copyFromSQL возвращает команду COPY FROM для перехватчиков, трассировки и статистики запросов
+func copyFromSQL(tableName pgx.Identifier, columnNames []string) string {
+	return fmt.Sprintf("COPY %s (%s) FROM STDIN", tableName.Sanitize(), quoteColumns(columnNames))
+}
+
+// copyFrom загружает строки rowSrc на подключении conn командой COPY ... FROM STDIN BINARY.
+// Строки кодируются так же, как в pgx.Conn.CopyFrom, но через счетчик байт, поэтому
+// возвращается не только количество загруженных строк, но и размер переданных данных
+func copyFrom(ctx context.Context, conn *pgx.Conn, tableName pgx.Identifier, columnNames []string, rowSrc pgx.CopyFromSource) (int64, int64, error) {
+	columns := quoteColumns(columnNames)
+
+	// Типы столбцов нужны для двоичного кодирования значений
+	sd, err := conn.Prepare(ctx, "", fmt.Sprintf("select %s from %s", columns, tableName.Sanitize()))
+	if err != nil {
+		return 0, 0, fmt.Errorf("statement description failed: %w", err)
+	}
+
+	r, w := io.Pipe()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		w.CloseWithError(encodeCopyRows(w, conn.TypeMap(), sd.Fields, rowSrc))
+	}()
+
+	cr := &countingReader{r: r}
+	tag, err := conn.PgConn().CopyFrom(ctx, cr, fmt.Sprintf("COPY %s (%s) FROM STDIN BINARY", tableName.Sanitize(), columns))
+	r.Close()
+	<-done
+
+	return tag.RowsAffected(), cr.n, err
+}
+
+// encodeCopyRows записывает строки rowSrc в w в двоичном формате COPY
+func encodeCopyRows(w io.Writer, m *pgtype.Map, fields []pgconn.FieldDescription, rowSrc pgx.CopyFromSource) error {
+	buf := make([]byte, 0, copyBufferSize)
+	buf = append(buf, "PGCOPY\n\377\r\n\000"...)
+	buf = binary.BigEndian.AppendUint32(buf, 0) // Флаги
+	buf = binary.BigEndian.AppendUint32(buf, 0) // Длина расширения заголовка
+
+	for rowSrc.Next() {
+		values, err := rowSrc.Values()
+		if err != nil {
+			return err
+		}
+		if len(values) != len(fields) {
+			return fmt.Errorf("expected %d values, got %d values", len(fields), len(values))
+		}
+
+		buf = binary.BigEndian.AppendUint16(buf, uint16(len(fields)))
+		for i, value := range values {
+			if buf, err = encodeCopyValue(m, buf, fields[i].DataTypeOID, value); err != nil {
+				return err
+			}
+		}
+
+		if len(buf) >= copyBufferSize {
+			if _, err := w.Write(buf); err != nil {
+				return err
+			}
+			buf = buf[:0]
+		}
+	}
+	if err := rowSrc.Err(); err != nil {
+		return err
+	}
+
+	_, err := w.Write(buf)
+	return err
+}
+
+// encodeCopyValue добавляет в buf значение столбца с типом oid в двоичном формате COPY.
+// Строка, которую нельзя закодировать напрямую, разбирается как текстовое представление типа
+func encodeCopyValue(m *pgtype.Map, buf []byte, oid uint32, value any) ([]byte, error) {
+	start := len(buf)
+	buf = binary.BigEndian.AppendUint32(buf, 0xFFFFFFFF) // NULL, если значение не закодировано
+
+	encoded, err := m.Encode(oid, pgtype.BinaryFormatCode, value, buf)
+	if err != nil {
+		s, ok := value.(string)
+		if !ok {
+			return nil, err
+		}
+		var parsed any
+		if scanErr := m.Scan(oid, pgtype.TextFormatCode, []byte(s), &parsed); scanErr != nil {
+			return nil, errors.Join(err, scanErr)
+		}
+		if encoded, err = m.Encode(oid, pgtype.BinaryFormatCode, parsed, buf); err != nil {
+			return nil, err
+		}
+	}
+	if encoded == nil {
+		return buf, nil
+	}
+
+	binary.BigEndian.PutUint32(encoded[start:], uint32(len(encoded)-start-4))
+	return encoded, nil
+}
+
+// copyTag возвращает результат COPY FROM с количеством загруженных строк
+func copyTag(rows int64) pgconn.CommandTag {
+	return pgconn.NewCommandTag("COPY " + strconv.FormatInt(rows, 10))
+}
+
+// copyTo выполняет COPY TO на подключении из пула и передает данные в w
+func (mc *masterConn) copyTo(ctx context.Context, sql string, w io.Writer, role string) (pgconn.CommandTag, error) {
+	// Применяем таймаут из конфигурации, если он задан
+	if mc.db.config.QueryTimeout > 0 {
+		var cancel func()
+		ctx, cancel = context.WithTimeout(ctx, mc.db.config.QueryTimeout)
+		defer cancel()
+	}
+
+	ctx, op, err := mc.startOperation(ctx, OperationCopyTo, sql, nil)
+	if err != nil {
+		return pgconn.CommandTag{}, err
+	}
+
+	// Повторяется только получение подключения: после начала выгрузки данные уже у получателя
+	var conn *pgxpool.Conn
+	err = mc.withReconnect(ctx, func(pool *pgxpool.Pool) (err error) {
+		conn, err = pool.Acquire(ctx)
+		return err
+	})
+	if err != nil {
+		op.end(err)
+		if mc.db.telemetry != nil {
+			mc.db.telemetry.RecordError()
+		}
+		return pgconn.CommandTag{}, fmt.Errorf("error executing copy on %s: %w", role, err)
+	}
+	defer conn.Release()
+
+	cw := &countingWriter{w: w}
+	tag, err := conn.Conn().PgConn().CopyTo(ctx, cw, op.SQL)
+	op.setResult(tag)
+	op.end(err)
+	if err != nil {
+		if mc.db.telemetry != nil {
+			mc.db.telemetry.RecordError()
+		}
+		mc.db.logger.ErrorContext(ctx, "Ошибка выполнения CopyTo на "+role, "error", err, "sql", sql, "bytes", cw.n)
+		if cw.n > 0 {
+			err = &partialCopyError{err: err, bytes: cw.n}
+		}
+		return tag, fmt.Errorf("error executing copy on %s: %w", role, err)
+	}
+
+	if mc.db.telemetry != nil {
+		mc.db.telemetry.RecordCopyTo(tag.RowsAffected(), cw.n)
+	}
+	mc.db.logger.DebugContext(ctx, "Выполнен CopyTo на "+role, "sql", sql, "rows", tag.RowsAffected(), "bytes", cw.n)
+	return tag, nil
+}
+
+// CopyFrom загружает строки в таблицу на мастере или во внешней транзакции из контекста.
+// Источник строк читается однократно, поэтому после начала загрузки операция не повторяется
+// при потере подключения
+func (mc *masterConn) CopyFrom(ctx context.Context, tableName pgx.Identifier, columnNames []string, rowSrc pgx.CopyFromSource) (int64, error) {
+	if tx, ok := mc.ambientTx(ctx); ok {
+		return tx.CopyFrom(ctx, tableName, columnNames, rowSrc)
+	}
+
+	// Применяем таймаут из конфигурации, если он задан
+	if mc.db.config.QueryTimeout > 0 {
+		var cancel func()
+		ctx, cancel = context.WithTimeout(ctx, mc.db.config.QueryTimeout)
+		defer cancel()
+	}
+
+	ctx, op, err := mc.startOperation(ctx, OperationCopyFrom, copyFromSQL(tableName, columnNames), nil)
+	if err != nil {
+		return 0, err
+	}
+
+	// Повторяется только получение подключения: источник строк еще не прочитан
+	var conn *pgxpool.Conn
+	err = mc.withReconnect(ctx, func(pool *pgxpool.Pool) (err error) {
+		conn, err = pool.Acquire(ctx)
+		return err
+	})
+	if err != nil {
+		op.end(err)
+		if mc.db.telemetry != nil {
+			mc.db.telemetry.RecordError()
+		}
+		return 0, fmt.Errorf("error executing copy on master: %w", err)
+	}
+	defer conn.Release()
+
+	rows, bytes, err := copyFrom(ctx, conn.Conn(), tableName, columnNames, rowSrc)
+	op.setResult(copyTag(rows))
+	op.end(err)
+	if err != nil {
+		if mc.db.telemetry != nil {
+			mc.db.telemetry.RecordError()
+		}
+		// Загрузка отклонена узлом, который перестал быть мастером
+		if mc.failover && isReadOnlyError(err) {
+			mc.db.requestTopologyRefresh()
+		}
+		mc.db.logger.ErrorContext(ctx, "Ошибка выполнения CopyFrom на мастере", "error", err, "table", tableName.Sanitize())
+		return rows, fmt.Errorf("error executing copy on master: %w", err)
+	}
+
+	if mc.db.telemetry != nil {
+		mc.db.telemetry.RecordCopyFrom(rows, bytes)
+	}
+	mc.db.logger.DebugContext(ctx, "Выполнен CopyFrom на мастере", "table", tableName.Sanitize(), "rows", rows, "bytes", bytes)
+	mc.db.captureCommitLSN(ctx)
+	return rows, nil
+}
+
+// CopyTo выполняет COPY ... TO STDOUT на мастере или во внешней транзакции из контекста и передает данные в w
+func (mc *masterConn) CopyTo(ctx context.Context, sql string, w io.Writer) (pgconn.CommandTag, error) {
+	if tx, ok := mc.ambientTx(ctx); ok {
+		return tx.CopyTo(ctx, sql, w)
+	}
+	return mc.copyTo(ctx, sql, w, "master")
+}
+
+// CopyFrom загружает строки в таблицу на реплике (только для мастера)
+func (rc *replicaConn) CopyFrom(ctx context.Context, tableName pgx.Identifier, columnNames []string, rowSrc pgx.CopyFromSource) (int64, error) {
+	return 0, ErrMasterOnlyOperation
+}
+
+// CopyTo выполняет COPY ... TO STDOUT на реплике и передает данные в w
+func (rc *replicaConn) CopyTo(ctx context.Context, sql string, w io.Writer) (pgconn.CommandTag, error) {
+	return rc.copyTo(ctx, sql, w, "replica")
+}
+
+// CopyFrom загружает строки в таблицу в транзакции
+func (t *txWrapper) CopyFrom(ctx context.Context, tableName pgx.Identifier, columnNames []string, rowSrc pgx.CopyFromSource) (int64, error) {
+	ctx, op, err := t.startOperation(ctx, OperationCopyFrom, copyFromSQL(tableName, columnNames), nil)
+	if err != nil {
+		return 0, err
+	}
+
+	rows, bytes, err := copyFrom(ctx, t.tx.Conn(), tableName, columnNames, rowSrc)
+	op.setResult(copyTag(rows))
+	op.end(err)
+	if err != nil {
+		if t.db.telemetry != nil {
+			t.db.telemetry.RecordError()
+		}
+		// Транзакция открыта на узле, который перестал быть мастером
+		if !t.readOnly && isReadOnlyError(err) {
+			t.db.requestTopologyRefresh()
+		}
+		return rows, fmt.Errorf("error executing copy in transaction: %w", err)
+	}
+
+	if t.db.telemetry != nil {
+		t.db.telemetry.RecordCopyFrom(rows, bytes)
+	}
+	return rows, nil
+}
+
+// CopyTo выполняет COPY ... TO STDOUT в транзакции и передает данные в w
+func (t *txWrapper) CopyTo(ctx context.Context, sql string, w io.Writer) (pgconn.CommandTag, error) {
+	ctx, op, err := t.startOperation(ctx, OperationCopyTo, sql, nil)
+	if err != nil {
+		return pgconn.CommandTag{}, err
+	}
+
+	cw := &countingWriter{w: w}
+	tag, err := t.tx.Conn().PgConn().CopyTo(ctx, cw, op.SQL)
+	op.setResult(tag)
+	op.end(err)
+	if err != nil {
+		if t.db.telemetry != nil {
+			t.db.telemetry.RecordError()
+		}
+		return tag, fmt.Errorf("error executing copy in transaction: %w", err)
+	}
+
+	if t.db.telemetry != nil {
+		t.db.telemetry.RecordCopyTo(tag.RowsAffected(), cw.n)
+	}
+	return tag, nil
+}
+
+// CopyFrom загружает строки в таблицу (только для мастера)
+func (rc *retryableConn) CopyFrom(ctx context.Context, tableName pgx.Identifier, columnNames []string, rowSrc pgx.CopyFromSource) (int64, error) {
+	return rc.conn.CopyFrom(ctx, tableName, columnNames, rowSrc)
+}
+
+// CopyTo выполняет COPY ... TO STDOUT с повторными попытками и переключением между репликами.
+// Если ошибка произошла после передачи части данных в w, операция не повторяется
+func (rc *retryableConn) CopyTo(ctx context.Context, sql string, w io.Writer) (pgconn.CommandTag, error) {
+	var result pgconn.CommandTag
+	var err error
+
+	err = rc.manager.ExecuteQueryWithRetry(ctx, func(conn Conn) error {
+		result, err = conn.CopyTo(ctx, sql, w)
+		return err
+	})
+
+	return result, err
+}
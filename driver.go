@@ -5,7 +5,7 @@ import (
 	"fmt"
 	"log/slog"
 
-	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
 )
 
 // New создает новый экземпляр драйвера
@@ -26,89 +26,220 @@ func New(ctx context.Context, config Config) (*DB, error) {
 		db.telemetry = NewTelemetry()
 	}
 
-	// Подключаемся к мастеру
-	var err error
-	db.master, err = pgx.Connect(ctx, config.MasterConnString)
+	if len(config.Hosts) > 0 {
+		// Определяем роли узлов кластера
+		var err error
+		db.hosts, err = newClusterHosts(ctx, config)
+		if err != nil {
+			return nil, fmt.Errorf("%w: cluster hosts error: %v", ErrConnectionFailed, err)
+		}
+		if err := db.refreshTopology(ctx); err != nil {
+			db.Close(ctx)
+			return nil, fmt.Errorf("%w: %v", ErrConnectionFailed, err)
+		}
+		db.topologyRefresh = make(chan struct{}, 1)
+	} else if err := db.connectStatic(ctx); err != nil {
+		return nil, err
+	}
+
+	// Инициализируем балансировщик асинхронных реплик
+	if config.Balancer != nil {
+		db.balancer = config.Balancer
+	} else {
+		db.balancer = NewRoundRobinBalancer()
+	}
+
+	// Устанавливаем флаг переключения между репликами
+	db.replicaFallback = !config.DisableReplicaFallback
+
+	db.backgroundCtx, db.stopBackground = context.WithCancel(context.Background())
+
+	// Запускаем мониторинг отставания реплик
+	if config.MaxReplicationLag > 0 {
+		// Первое измерение выполняем сразу, чтобы отстающие реплики не использовались до первой проверки
+		db.sampleReplicationLag(ctx, db.replicationLagCheckInterval())
+		db.runBackground(db.backgroundCtx, db.monitorReplicationLag)
+	}
+
+	// Запускаем перепроверку ролей узлов кластера
+	if len(db.hosts) > 0 {
+		db.runBackground(db.backgroundCtx, db.watchTopology)
+	}
+
+	// Запускаем фоновую проверку доступности узлов
+	if config.HealthCheckInterval > 0 {
+		db.runBackground(db.backgroundCtx, db.checkHealth)
+	}
+
+	return db, nil
+}
+
+// connectStatic создает пулы подключений к узлам с ролями, заданными в конфигурации
+func (db *DB) connectStatic(ctx context.Context) error {
+	config := db.config
+
+	// Создаем пул подключений к мастеру
+	pool, err := newPool(ctx, config.MasterConnString, config.MasterPool)
 	if err != nil {
-		return nil, fmt.Errorf("%w: master connection error: %v", ErrConnectionFailed, err)
+		return fmt.Errorf("%w: master connection error: %v", ErrConnectionFailed, err)
 	}
+	db.master = &node{name: "master", pool: pool, isMaster: true}
 
-	// Подключаемся к синхронной реплике
+	// Создаем пул подключений к синхронной реплике
 	if config.SyncSlaveConnString != "" {
-		db.syncSlave, err = pgx.Connect(ctx, config.SyncSlaveConnString)
+		pool, err = newPool(ctx, config.SyncSlaveConnString, config.SyncSlavePool)
 		if err != nil {
-			return nil, fmt.Errorf("%w: synchronous replica connection error: %v", ErrConnectionFailed, err)
+			db.Close(ctx)
+			return fmt.Errorf("%w: synchronous replica connection error: %v", ErrConnectionFailed, err)
 		}
+		db.syncSlave = &node{name: "sync slave", pool: pool, replicaType: SyncReplica}
 	}
 
-	// Подключаемся к асинхронной реплике
-	if config.AsyncSlaveConnString != "" {
-		db.asyncSlave, err = pgx.Connect(ctx, config.AsyncSlaveConnString)
+	// Создаем пулы подключений к асинхронным репликам
+	for i, connString := range asyncSlaveConnStrings(config) {
+		pool, err = newPool(ctx, connString, config.AsyncSlavePool)
 		if err != nil {
-			return nil, fmt.Errorf("%w: asynchronous replica connection error: %v", ErrConnectionFailed, err)
+			db.Close(ctx)
+			return fmt.Errorf("%w: asynchronous replica %d connection error: %v", ErrConnectionFailed, i, err)
 		}
+		db.asyncSlaves = append(db.asyncSlaves, &node{
+			name:        fmt.Sprintf("async slave %d", i),
+			pool:        pool,
+			replicaType: AsyncReplica,
+			index:       i,
+		})
 	}
 
-	// Устанавливаем флаг переключения между репликами
-	db.replicaFallback = !config.DisableReplicaFallback
+	return nil
+}
 
-	return db, nil
+// asyncSlaveConnStrings возвращает строки подключения ко всем асинхронным репликам
+func asyncSlaveConnStrings(config Config) []string {
+	var connStrings []string
+	if config.AsyncSlaveConnString != "" {
+		connStrings = append(connStrings, config.AsyncSlaveConnString)
+	}
+	for _, connString := range config.AsyncSlaveConnStrings {
+		if connString != "" {
+			connStrings = append(connStrings, connString)
+		}
+	}
+	return connStrings
+}
+
+// newPoolConfig создает конфигурацию пула подключений с параметрами роли
+func newPoolConfig(connString string, pc PoolConfig) (*pgxpool.Config, error) {
+	poolConfig, err := pgxpool.ParseConfig(connString)
+	if err != nil {
+		return nil, err
+	}
+
+	if pc.MaxConns > 0 {
+		poolConfig.MaxConns = pc.MaxConns
+	}
+	if pc.MinConns > 0 {
+		poolConfig.MinConns = pc.MinConns
+	}
+	if pc.MaxConnLifetime > 0 {
+		poolConfig.MaxConnLifetime = pc.MaxConnLifetime
+	}
+	if pc.MaxConnIdleTime > 0 {
+		poolConfig.MaxConnIdleTime = pc.MaxConnIdleTime
+	}
+
+	return poolConfig, nil
+}
+
+// newPool создает пул подключений с параметрами роли и проверяет доступность сервера
+func newPool(ctx context.Context, connString string, pc PoolConfig) (*pgxpool.Pool, error) {
+	poolConfig, err := newPoolConfig(connString, pc)
+	if err != nil {
+		return nil, err
+	}
+
+	pool, err := pgxpool.NewWithConfig(ctx, poolConfig)
+	if err != nil {
+		return nil, err
+	}
+
+	// pgxpool подключается лениво, поэтому проверяем доступность сервера сразу,
+	// чтобы ошибки конфигурации обнаруживались при создании драйвера
+	if err := pool.Ping(ctx); err != nil {
+		pool.Close()
+		return nil, err
+	}
+
+	return pool, nil
 }
 
 // Master возвращает подключение к мастеру
 func (db *DB) Master() Conn {
-	return &masterConn{conn: db.master, db: db}
+	return db.currentTopology().master.conn(db)
 }
 
 // SyncSlave возвращает подключение к синхронной реплике
 func (db *DB) SyncSlave() Conn {
-	if db.syncSlave == nil {
+	syncSlave := db.currentTopology().syncSlave
+	if syncSlave == nil {
 		db.logger.Info("SyncSlave недоступен")
 		return db.Master()
 	}
-	conn := &replicaConn{masterConn{conn: db.syncSlave, db: db}, SyncReplica}
 	// Оборачиваем в ReplicaManager для поддержки повторных попыток и переключения
 	rm := NewReplicaManager(db)
-	return &retryableConn{conn: conn, manager: rm}
+	rm.replicaType = SyncReplica
+	return &retryableConn{conn: syncSlave.conn(db), manager: rm}
 }
 
-// Slave возвращает подключение к асинхронной реплике
+// Slave возвращает подключение к асинхронным репликам.
+// Реплика для каждой операции выбирается балансировщиком
 func (db *DB) Slave() Conn {
-	if db.asyncSlave == nil {
+	asyncSlaves := db.currentTopology().asyncSlaves
+	if len(asyncSlaves) == 0 {
 		db.logger.Info("Slave недоступен")
 		return db.SyncSlave()
 	}
-	conn := &replicaConn{masterConn{conn: db.asyncSlave, db: db}, AsyncReplica}
 	// Оборачиваем в ReplicaManager для поддержки повторных попыток и переключения
 	rm := NewReplicaManager(db)
-	return &retryableConn{conn: conn, manager: rm}
+	return &retryableConn{conn: asyncSlaves[0].conn(db), manager: rm}
 }
 
-// Close закрывает все подключения
-func (db *DB) Close(ctx context.Context) error {
-	var errs []error
+// Telemetry возвращает телеметрию драйвера или nil, если она не включена (Config.EnableTelemetry)
+func (db *DB) Telemetry() *Telemetry {
+	return db.telemetry
+}
 
-	if db.master != nil {
-		if err := db.master.Close(ctx); err != nil {
-			errs = append(errs, fmt.Errorf("master connection close error: %w", err))
-		}
-	}
+// runBackground запускает фоновую задачу, которая останавливается при закрытии драйвера.
+// Возвращает false без запуска задачи, если закрытие драйвера уже началось
+func (db *DB) runBackground(ctx context.Context, task func(context.Context)) bool {
+	db.backgroundMu.Lock()
+	defer db.backgroundMu.Unlock()
 
-	if db.syncSlave != nil {
-		if err := db.syncSlave.Close(ctx); err != nil {
-			errs = append(errs, fmt.Errorf("synchronous replica close error: %w", err))
-		}
+	// Add после начала Wait в Close недопустим для sync.WaitGroup
+	if db.backgroundCtx != nil && db.backgroundCtx.Err() != nil {
+		return false
 	}
 
-	if db.asyncSlave != nil {
-		if err := db.asyncSlave.Close(ctx); err != nil {
-			errs = append(errs, fmt.Errorf("asynchronous replica close error: %w", err))
-		}
+	db.background.Add(1)
+	go func() {
+		defer db.background.Done()
+		task(ctx)
+	}()
+	return true
+}
+
+// Close останавливает фоновые задачи и закрывает все пулы подключений
+func (db *DB) Close(ctx context.Context) error {
+	if db.stopBackground != nil {
+		db.backgroundMu.Lock()
+		db.stopBackground()
+		db.backgroundMu.Unlock()
+		db.background.Wait()
 	}
 
-	if len(errs) > 0 {
-		return fmt.Errorf("errors closing connections: %v", errs)
+	for _, n := range db.currentTopology().nodes() {
+		n.close()
 	}
+	closeClusterHosts(db.hosts)
 
 	return nil
 }
@@ -30,3 +30,15 @@ var ErrReplicaNotReady = errors.New("replica is not ready to accept requests")
 
 // ErrQueryTimeout ошибка таймаута выполнения запроса
 var ErrQueryTimeout = errors.New("query timeout exceeded")
+
+// ErrMasterNotFound ошибка, когда среди узлов кластера не найден мастер
+var ErrMasterNotFound = errors.New("master not found among cluster hosts")
+
+// ErrDBClosed ошибка, когда драйвер уже закрыт
+var ErrDBClosed = errors.New("db is closed")
+
+// ErrTxOptionsConflict ошибка, когда параметры вложенной транзакции отличаются от параметров внешней
+var ErrTxOptionsConflict = errors.New("transaction options conflict with outer transaction")
+
+// ErrResultTooLarge ошибка, когда результат запроса превышает ограничения буферизации
+var ErrResultTooLarge = errors.New("query result exceeds buffer limits")
@@ -0,0 +1,269 @@
+package pgxwrapper
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+const (
+	// defaultCircuitBreakerThreshold количество ошибок подряд, после которого узел считается недоступным
+	defaultCircuitBreakerThreshold = 3
+
+	// defaultCircuitBreakerCooldown время, через которое недоступный узел снова проверяется
+	defaultCircuitBreakerCooldown = 30 * time.Second
+)
+
+// NodeState состояние узла кластера
+type NodeState int
+
+const (
+	// NodeHealthy узел работает без ошибок
+	NodeHealthy NodeState = iota
+
+	// NodeSuspect на узле были ошибки подключения, но порог еще не превышен
+	NodeSuspect
+
+	// NodeDown узел недоступен, запросы на него не направляются (цепь разомкнута)
+	NodeDown
+
+	// NodeRecovering время ожидания истекло, выполняется пробный запрос (цепь полуоткрыта)
+	NodeRecovering
+)
+
+// String возвращает название состояния узла
+func (s NodeState) String() string {
+	switch s {
+	case NodeHealthy:
+		return "healthy"
+	case NodeSuspect:
+		return "suspect"
+	case NodeDown:
+		return "down"
+	case NodeRecovering:
+		return "recovering"
+	default:
+		return "unknown"
+	}
+}
+
+// NodeStatus состояние узла кластера
+type NodeStatus struct {
+	// Name имя узла
+	Name string
+
+	// Master признак мастера
+	Master bool
+
+	// State состояние узла
+	State NodeState
+
+	// Since время последнего изменения состояния
+	Since time.Time
+
+	// ConsecutiveFailures количество ошибок подключения подряд
+	ConsecutiveFailures int
+
+	// LastError последняя ошибка подключения
+	LastError error
+
+	// InFlight количество операций, выполняющихся на узле в данный момент
+	InFlight int64
+
+	// ReplicationLag последнее измеренное отставание реплики
+	ReplicationLag time.Duration
+}
+
+// nodeHealth автомат состояний узла с автоматическим выключателем
+type nodeHealth struct {
+	mu sync.Mutex
+
+	state     NodeState
+	since     time.Time
+	failures  int
+	lastError error
+}
+
+// allow проверяет, можно ли направить запрос на узел.
+// По истечении cooldown недоступный узел переходит в состояние восстановления
+// и пропускает один пробный запрос
+func (h *nodeHealth) allow(now time.Time, cooldown time.Duration) bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	switch h.state {
+	case NodeDown:
+		if now.Sub(h.since) < cooldown {
+			return false
+		}
+		h.state = NodeRecovering
+		h.since = now
+		return true
+	case NodeRecovering:
+		// Пробный запрос уже выполняется
+		return false
+	default:
+		return true
+	}
+}
+
+// rejects проверяет, будет ли запрос на узел отклонен, не меняя состояния
+func (h *nodeHealth) rejects(now time.Time, cooldown time.Duration) bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	switch h.state {
+	case NodeDown:
+		return now.Sub(h.since) < cooldown
+	case NodeRecovering:
+		return true
+	default:
+		return false
+	}
+}
+
+// success фиксирует успешное обращение к узлу
+func (h *nodeHealth) success(now time.Time) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if h.state != NodeHealthy {
+		h.since = now
+	}
+	h.state = NodeHealthy
+	h.failures = 0
+	h.lastError = nil
+}
+
+// failure фиксирует ошибку подключения к узлу и возвращает новое состояние
+func (h *nodeHealth) failure(now time.Time, err error, threshold int) NodeState {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.failures++
+	h.lastError = err
+
+	previous := h.state
+	if h.state == NodeRecovering || h.failures >= threshold {
+		h.state = NodeDown
+	} else {
+		h.state = NodeSuspect
+	}
+	if h.state != previous || h.state == NodeDown {
+		h.since = now
+	}
+
+	return h.state
+}
+
+// status возвращает текущее состояние
+func (h *nodeHealth) status() (NodeState, time.Time, int, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.state, h.since, h.failures, h.lastError
+}
+
+// circuitBreakerThreshold возвращает порог ошибок автоматического выключателя
+func (db *DB) circuitBreakerThreshold() int {
+	if db.config.CircuitBreakerThreshold > 0 {
+		return db.config.CircuitBreakerThreshold
+	}
+	return defaultCircuitBreakerThreshold
+}
+
+// circuitBreakerCooldown возвращает время ожидания автоматического выключателя
+func (db *DB) circuitBreakerCooldown() time.Duration {
+	if db.config.CircuitBreakerCooldown > 0 {
+		return db.config.CircuitBreakerCooldown
+	}
+	return defaultCircuitBreakerCooldown
+}
+
+// nodeAvailable проверяет, можно ли направить запрос на узел
+func (db *DB) nodeAvailable(n *node) bool {
+	return n.health.allow(time.Now(), db.circuitBreakerCooldown())
+}
+
+// nodeUnavailable проверяет, отклонит ли автоматический выключатель запрос на узел.
+// В отличие от nodeAvailable не переводит узел в состояние восстановления
+func (db *DB) nodeUnavailable(n *node) bool {
+	return n.health.rejects(time.Now(), db.circuitBreakerCooldown())
+}
+
+// reportNodeResult обновляет состояние узла по результату операции.
+// Ошибки, не указывающие на недоступность узла, означают, что узел отвечает
+func (db *DB) reportNodeResult(ctx context.Context, n *node, err error) {
+	if !db.classifyError(err).NodeFailure() {
+		n.health.success(time.Now())
+		return
+	}
+	db.reportNodeFailure(ctx, n, err)
+}
+
+// reportNodeFailure фиксирует ошибку подключения к узлу
+func (db *DB) reportNodeFailure(ctx context.Context, n *node, err error) {
+	if n.health.failure(time.Now(), err, db.circuitBreakerThreshold()) == NodeDown {
+		db.logger.WarnContext(ctx, "Узел помечен как недоступный", "node", n.name, "error", err)
+	}
+}
+
+// NodeStatus возвращает состояние всех узлов кластера
+func (db *DB) NodeStatus() []NodeStatus {
+	nodes := db.currentTopology().nodes()
+	statuses := make([]NodeStatus, 0, len(nodes))
+	for _, n := range nodes {
+		state, since, failures, lastErr := n.health.status()
+		statuses = append(statuses, NodeStatus{
+			Name:                n.name,
+			Master:              n.isMaster,
+			State:               state,
+			Since:               since,
+			ConsecutiveFailures: failures,
+			LastError:           lastErr,
+			InFlight:            n.inFlight.Load(),
+			ReplicationLag:      n.getReplicationState().lag,
+		})
+	}
+	return statuses
+}
+
+// checkHealth периодически проверяет доступность узлов до отмены контекста
+func (db *DB) checkHealth(ctx context.Context) {
+	ticker := time.NewTicker(db.config.HealthCheckInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			for _, n := range db.currentTopology().nodes() {
+				db.pingNode(ctx, n)
+			}
+		}
+	}
+}
+
+// pingNode проверяет доступность узла, если автоматический выключатель это разрешает
+func (db *DB) pingNode(ctx context.Context, n *node) {
+	if !db.nodeAvailable(n) {
+		return
+	}
+
+	pingCtx, cancel := context.WithTimeout(ctx, db.config.HealthCheckInterval)
+	defer cancel()
+
+	err := n.pool.Ping(pingCtx)
+	switch {
+	case err == nil:
+		n.health.success(time.Now())
+	case ctx.Err() != nil:
+		// Проверка прервана закрытием драйвера
+	default:
+		if db.telemetry != nil {
+			db.telemetry.RecordConnectionError()
+		}
+		// Любая ошибка проверки, включая таймаут, означает недоступность узла
+		db.reportNodeFailure(ctx, n, err)
+	}
+}
@@ -0,0 +1,125 @@
+package pgxwrapper
+
+import (
+	"context"
+	"time"
+)
+
+// defaultReplicationLagCheckInterval интервал проверки отставания реплик по умолчанию
+const defaultReplicationLagCheckInterval = 5 * time.Second
+
+// replicationLagQuery запрос, возвращающий отставание реплики и позицию применения WAL.
+// Если реплика применила все полученные записи, отставание считается нулевым,
+// иначе оно равно времени с момента последней примененной транзакции
+const replicationLagQuery = `SELECT
+	pg_is_in_recovery(),
+	CASE
+		WHEN pg_last_wal_receive_lsn() = pg_last_wal_replay_lsn() THEN 0
+		ELSE EXTRACT(EPOCH FROM now() - pg_last_xact_replay_timestamp())::float8
+	END,
+	pg_last_wal_replay_lsn()::text`
+
+// replicationState состояние репликации узла по результатам последней проверки
+type replicationState struct {
+	// known признак того, что отставание удалось измерить
+	known bool
+
+	// lag отставание реплики; отрицательное значение означает,
+	// что реплика еще не применила ни одной транзакции
+	lag time.Duration
+
+	// replayLSN позиция последней примененной записи WAL
+	replayLSN LSN
+
+	// sampledAt время последней успешной проверки
+	sampledAt time.Time
+}
+
+// replicationLagCheckInterval возвращает интервал проверки отставания реплик
+func (db *DB) replicationLagCheckInterval() time.Duration {
+	if db.config.ReplicationLagCheckInterval > 0 {
+		return db.config.ReplicationLagCheckInterval
+	}
+	return defaultReplicationLagCheckInterval
+}
+
+// monitorReplicationLag периодически измеряет отставание реплик до отмены контекста
+func (db *DB) monitorReplicationLag(ctx context.Context) {
+	interval := db.replicationLagCheckInterval()
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			db.sampleReplicationLag(ctx, interval)
+		}
+	}
+}
+
+// sampleReplicationLag измеряет отставание всех реплик
+func (db *DB) sampleReplicationLag(ctx context.Context, timeout time.Duration) {
+	for _, n := range db.currentTopology().replicas() {
+		if err := db.sampleNodeLag(ctx, n, timeout); err != nil {
+			db.logger.WarnContext(ctx, "Не удалось измерить отставание реплики", "replica", n.name, "error", err)
+		}
+	}
+}
+
+// sampleNodeLag измеряет отставание одной реплики
+func (db *DB) sampleNodeLag(ctx context.Context, n *node, timeout time.Duration) error {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	var (
+		inRecovery bool
+		lagSeconds *float64
+		replayLSN  *string
+	)
+	err := n.pool.QueryRow(ctx, replicationLagQuery).Scan(&inRecovery, &lagSeconds, &replayLSN)
+	if err != nil {
+		n.setReplicationState(replicationState{})
+		return err
+	}
+
+	state := replicationState{known: true, sampledAt: time.Now()}
+	switch {
+	case !inRecovery:
+		// Узел не находится в режиме восстановления и не отстает
+	case lagSeconds == nil:
+		state.lag = -1
+	default:
+		state.lag = time.Duration(*lagSeconds * float64(time.Second))
+	}
+
+	if replayLSN != nil {
+		state.replayLSN, err = ParseLSN(*replayLSN)
+		if err != nil {
+			n.setReplicationState(replicationState{})
+			return err
+		}
+	}
+
+	n.setReplicationState(state)
+	db.logger.DebugContext(ctx, "Измерено отставание реплики", "replica", n.name, "lag", state.lag, "replay_lsn", state.replayLSN)
+	return nil
+}
+
+// replicationLagExceeded проверяет, превышает ли отставание узла Config.MaxReplicationLag.
+// Узлы с неизвестным отставанием не исключаются: недоступность реплики
+// обнаруживается по ошибкам подключения
+func (db *DB) replicationLagExceeded(n *node) (time.Duration, bool) {
+	if n.isMaster || db.config.MaxReplicationLag <= 0 {
+		return 0, false
+	}
+
+	state := n.getReplicationState()
+	if !state.known {
+		return 0, false
+	}
+
+	return state.lag, state.lag < 0 || state.lag > db.config.MaxReplicationLag
+}
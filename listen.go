@@ -0,0 +1,173 @@
+package pgxwrapper
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+)
+
+const (
+	// notificationBufferSize размер буфера канала уведомлений
+	notificationBufferSize = 64
+
+	// listenCloseTimeout время на корректное закрытие подключения для уведомлений
+	listenCloseTimeout = time.Second
+)
+
+// Notification уведомление, полученное по подписке LISTEN
+type Notification struct {
+	// PID идентификатор серверного процесса, отправившего уведомление
+	PID uint32
+
+	// Channel канал уведомления
+	Channel string
+
+	// Payload содержимое уведомления
+	Payload string
+}
+
+// Listen подписывается на уведомления каналов channels на мастере и возвращает канал,
+// в который они доставляются. Для подписки открывается отдельное подключение вне пула;
+// после его потери драйвер переподключается к текущему мастеру и повторяет подписку.
+// Уведомления, отправленные во время переподключения, не доставляются.
+// Канал закрывается при отмене ctx или закрытии драйвера
+func (db *DB) Listen(ctx context.Context, channels ...string) (<-chan Notification, error) {
+	if len(channels) == 0 {
+		return nil, fmt.Errorf("%w: no channels to listen", ErrInvalidConfiguration)
+	}
+
+	conn, err := db.listenConn(ctx, channels)
+	if err != nil {
+		if db.telemetry != nil {
+			db.telemetry.RecordConnectionError()
+		}
+		return nil, fmt.Errorf("error subscribing to notifications: %w", err)
+	}
+
+	notifications := make(chan Notification, notificationBufferSize)
+
+	// Подписка завершается как при отмене ctx, так и при закрытии драйвера
+	listenCtx, cancel := context.WithCancel(ctx)
+	stop := func() bool { return false }
+	if db.backgroundCtx != nil {
+		stop = context.AfterFunc(db.backgroundCtx, cancel)
+	}
+
+	started := db.runBackground(listenCtx, func(ctx context.Context) {
+		defer close(notifications)
+		defer stop()
+		defer cancel()
+		db.listen(ctx, conn, channels, notifications)
+	})
+	if !started {
+		stop()
+		cancel()
+		closeListenConn(conn)
+		return nil, fmt.Errorf("error subscribing to notifications: %w", ErrDBClosed)
+	}
+
+	return notifications, nil
+}
+
+// Notify отправляет уведомление в канал channel через pg_notify на мастере.
+// Внутри транзакции из контекста уведомление доставляется после ее фиксации
+func (db *DB) Notify(ctx context.Context, channel, payload string) error {
+	if _, err := db.Master().Exec(ctx, "SELECT pg_notify($1, $2)", channel, payload); err != nil {
+		return fmt.Errorf("error sending notification: %w", err)
+	}
+	return nil
+}
+
+// listenConn открывает выделенное подключение к текущему мастеру и подписывается на каналы
+func (db *DB) listenConn(ctx context.Context, channels []string) (*pgx.Conn, error) {
+	master := db.currentTopology().master
+	if master == nil || master.pool == nil {
+		return nil, ErrConnectionFailed
+	}
+
+	conn, err := pgx.ConnectConfig(ctx, master.pool.Config().ConnConfig.Copy())
+	if err != nil {
+		return nil, err
+	}
+
+	for _, channel := range channels {
+		if _, err := conn.Exec(ctx, "LISTEN "+pgx.Identifier{channel}.Sanitize()); err != nil {
+			closeListenConn(conn)
+			return nil, err
+		}
+	}
+
+	return conn, nil
+}
+
+// listen доставляет уведомления в out до отмены контекста, переподключаясь при ошибках
+func (db *DB) listen(ctx context.Context, conn *pgx.Conn, channels []string, out chan<- Notification) {
+	defer func() {
+		closeListenConn(conn)
+	}()
+
+	for {
+		n, err := conn.WaitForNotification(ctx)
+		if err == nil {
+			select {
+			case out <- Notification{PID: n.PID, Channel: n.Channel, Payload: n.Payload}:
+			case <-ctx.Done():
+				return
+			}
+			continue
+		}
+
+		if ctx.Err() != nil {
+			return
+		}
+
+		db.logger.WarnContext(ctx, "Подключение для уведомлений потеряно, переподключение", "error", err)
+		if db.telemetry != nil {
+			db.telemetry.RecordConnectionError()
+		}
+
+		closeListenConn(conn)
+		if conn = db.resubscribe(ctx, channels); conn == nil {
+			return
+		}
+	}
+}
+
+// resubscribe переподключается к мастеру с экспоненциально растущей задержкой и повторяет подписку.
+// Возвращает nil, если контекст отменен до успешного переподключения
+func (db *DB) resubscribe(ctx context.Context, channels []string) *pgx.Conn {
+	b := newBackoff(RetryPolicy{
+		Strategy:  BackoffExponential,
+		BaseDelay: reconnectInitialDelay,
+		MaxDelay:  reconnectMaxDelay,
+	})
+
+	for {
+		if err := b.wait(ctx); err != nil {
+			return nil
+		}
+
+		conn, err := db.listenConn(ctx, channels)
+		if err == nil {
+			db.logger.InfoContext(ctx, "Подписка на уведомления восстановлена", "channels", channels)
+			return conn
+		}
+
+		db.logger.WarnContext(ctx, "Ошибка переподключения для уведомлений", "error", err)
+		if db.telemetry != nil {
+			db.telemetry.RecordConnectionError()
+		}
+	}
+}
+
+// closeListenConn закрывает подключение для уведомлений, не дожидаясь недоступного сервера дольше listenCloseTimeout
+func closeListenConn(conn *pgx.Conn) {
+	if conn == nil {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), listenCloseTimeout)
+	defer cancel()
+	conn.Close(ctx)
+}
@@ -0,0 +1,35 @@
+package pgxwrapper
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// LSN позиция в журнале предзаписи (WAL) PostgreSQL
+type LSN uint64
+
+// ParseLSN разбирает LSN в текстовом формате PostgreSQL, например "16/B374D848"
+func ParseLSN(s string) (LSN, error) {
+	hi, lo, ok := strings.Cut(s, "/")
+	if !ok {
+		return 0, fmt.Errorf("invalid LSN %q", s)
+	}
+
+	h, err := strconv.ParseUint(hi, 16, 32)
+	if err != nil {
+		return 0, fmt.Errorf("invalid LSN %q: %w", s, err)
+	}
+
+	l, err := strconv.ParseUint(lo, 16, 32)
+	if err != nil {
+		return 0, fmt.Errorf("invalid LSN %q: %w", s, err)
+	}
+
+	return LSN(h<<32 | l), nil
+}
+
+// String возвращает LSN в текстовом формате PostgreSQL
+func (l LSN) String() string {
+	return fmt.Sprintf("%X/%X", uint32(l>>32), uint32(l))
+}
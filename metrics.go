@@ -0,0 +1,223 @@
+package pgxwrapper
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// Роли узлов в метках метрик
+const (
+	roleMaster = "master"
+	roleSync   = "sync"
+	roleAsync  = "async"
+)
+
+// latencyBuckets верхние границы интервалов гистограммы длительности операций в секундах
+var latencyBuckets = []float64{0.001, 0.0025, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+// operationKey метки метрик операции
+type operationKey struct {
+	role      string
+	operation string
+}
+
+// operationMetrics метрики операций с одинаковыми метками
+type operationMetrics struct {
+	count    int64
+	errors   int64
+	inFlight int64
+
+	// buckets количество операций в каждом интервале latencyBuckets;
+	// последний элемент - операции длительнее верхней границы
+	buckets  []int64
+	duration time.Duration
+}
+
+// role возвращает роль узла для меток метрик
+func (n *node) role() string {
+	switch {
+	case n.isMaster:
+		return roleMaster
+	case n.replicaType == SyncReplica:
+		return roleSync
+	default:
+		return roleAsync
+	}
+}
+
+// operationMetricsLocked возвращает метрики операции, создавая их при необходимости.
+// Вызывается под блокировкой t.mu
+func (t *Telemetry) operationMetricsLocked(role, operation string) *operationMetrics {
+	key := operationKey{role: role, operation: operation}
+	if t.operations == nil {
+		t.operations = make(map[operationKey]*operationMetrics)
+	}
+	m, ok := t.operations[key]
+	if !ok {
+		m = &operationMetrics{buckets: make([]int64, len(latencyBuckets)+1)}
+		t.operations[key] = m
+	}
+	return m
+}
+
+// RecordOperation записывает длительность и результат операции operation на узле с ролью role
+func (t *Telemetry) RecordOperation(role, operation string, duration time.Duration, err error) {
+	if !t.IsEnabled() {
+		return
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.recordOperationLocked(t.operationMetricsLocked(role, operation), duration, err)
+}
+
+// recordOperationLocked учитывает завершенную операцию. Вызывается под блокировкой t.mu
+func (t *Telemetry) recordOperationLocked(m *operationMetrics, duration time.Duration, err error) {
+	m.count++
+	m.duration += duration
+	m.buckets[sort.SearchFloat64s(latencyBuckets, duration.Seconds())]++
+	// Отсутствие строк - результат запроса, а не сбой операции
+	if err != nil && !errors.Is(err, pgx.ErrNoRows) {
+		m.errors++
+	}
+}
+
+// startOperation отмечает начало операции и возвращает функцию ее завершения.
+// Пока операция не завершена, она учитывается в количестве выполняющихся операций.
+// Безопасен для вызова на nil, если телеметрия не включена
+func (t *Telemetry) startOperation(role, operation string) func(err error) {
+	if t == nil || !t.IsEnabled() {
+		return func(error) {}
+	}
+
+	t.mu.Lock()
+	m := t.operationMetricsLocked(role, operation)
+	m.inFlight++
+	t.mu.Unlock()
+
+	start := time.Now()
+	return func(err error) {
+		duration := time.Since(start)
+
+		t.mu.Lock()
+		m.inFlight--
+		t.recordOperationLocked(m, duration, err)
+		t.totalQueries++
+		t.queryDuration += duration
+		t.mu.Unlock()
+	}
+}
+
+// Handler возвращает http.Handler, отдающий метрики в текстовом формате Prometheus
+func (t *Telemetry) Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		if err := t.WritePrometheus(w); err != nil {
+			t.logger.ErrorContext(r.Context(), "Ошибка отправки метрик", "error", err)
+		}
+	})
+}
+
+// operationSnapshot копия метрик операции для вывода без блокировки телеметрии
+type operationSnapshot struct {
+	key operationKey
+	operationMetrics
+}
+
+// WritePrometheus записывает метрики в w в текстовом формате Prometheus.
+// Метрики копируются под блокировкой, запись в w выполняется без нее, чтобы медленный
+// клиент не задерживал учет операций
+func (t *Telemetry) WritePrometheus(w io.Writer) error {
+	t.mu.RLock()
+	counters := []struct {
+		name, help string
+		value      int64
+	}{
+		{"pgxwrapper_queries_total", "Total number of executed queries.", t.totalQueries},
+		{"pgxwrapper_errors_total", "Total number of query errors.", t.totalErrors},
+		{"pgxwrapper_retries_total", "Total number of retried operations.", t.totalRetries},
+		{"pgxwrapper_connection_errors_total", "Total number of connection errors.", t.connectionErrors},
+		{"pgxwrapper_copy_from_rows_total", "Rows loaded with COPY FROM.", t.copyFromRows},
+		{"pgxwrapper_copy_from_bytes_total", "Bytes loaded with COPY FROM.", t.copyFromBytes},
+		{"pgxwrapper_copy_to_rows_total", "Rows exported with COPY TO.", t.copyToRows},
+		{"pgxwrapper_copy_to_bytes_total", "Bytes exported with COPY TO.", t.copyToBytes},
+	}
+	operations := make([]operationSnapshot, 0, len(t.operations))
+	for key, m := range t.operations {
+		snapshot := operationSnapshot{key: key, operationMetrics: *m}
+		snapshot.buckets = slices.Clone(m.buckets)
+		operations = append(operations, snapshot)
+	}
+	t.mu.RUnlock()
+
+	// Метки выводятся в постоянном порядке, чтобы вывод не менялся между запросами
+	sort.Slice(operations, func(i, j int) bool {
+		if operations[i].key.role != operations[j].key.role {
+			return operations[i].key.role < operations[j].key.role
+		}
+		return operations[i].key.operation < operations[j].key.operation
+	})
+
+	bw := bufio.NewWriter(w)
+
+	for _, c := range counters {
+		fmt.Fprintf(bw, "# HELP %s %s\n# TYPE %s counter\n%s %d\n", c.name, c.help, c.name, c.name, c.value)
+	}
+
+	if len(operations) > 0 {
+		fmt.Fprint(bw, "# HELP pgxwrapper_operations_total Number of completed operations by node role and operation.\n")
+		fmt.Fprint(bw, "# TYPE pgxwrapper_operations_total counter\n")
+		for _, m := range operations {
+			fmt.Fprintf(bw, "pgxwrapper_operations_total{%s} %d\n", m.key.labels(), m.count)
+		}
+
+		fmt.Fprint(bw, "# HELP pgxwrapper_operation_errors_total Number of failed operations by node role and operation.\n")
+		fmt.Fprint(bw, "# TYPE pgxwrapper_operation_errors_total counter\n")
+		for _, m := range operations {
+			fmt.Fprintf(bw, "pgxwrapper_operation_errors_total{%s} %d\n", m.key.labels(), m.errors)
+		}
+
+		fmt.Fprint(bw, "# HELP pgxwrapper_operations_in_flight Number of operations currently executing.\n")
+		fmt.Fprint(bw, "# TYPE pgxwrapper_operations_in_flight gauge\n")
+		for _, m := range operations {
+			fmt.Fprintf(bw, "pgxwrapper_operations_in_flight{%s} %d\n", m.key.labels(), m.inFlight)
+		}
+
+		fmt.Fprint(bw, "# HELP pgxwrapper_operation_duration_seconds Operation latency by node role and operation.\n")
+		fmt.Fprint(bw, "# TYPE pgxwrapper_operation_duration_seconds histogram\n")
+		for _, m := range operations {
+			labels := m.key.labels()
+			var cumulative int64
+			for i, bound := range latencyBuckets {
+				cumulative += m.buckets[i]
+				fmt.Fprintf(bw, "pgxwrapper_operation_duration_seconds_bucket{%s,le=%q} %d\n",
+					labels, strconv.FormatFloat(bound, 'g', -1, 64), cumulative)
+			}
+			fmt.Fprintf(bw, "pgxwrapper_operation_duration_seconds_bucket{%s,le=\"+Inf\"} %d\n", labels, m.count)
+			fmt.Fprintf(bw, "pgxwrapper_operation_duration_seconds_sum{%s} %s\n",
+				labels, strconv.FormatFloat(m.duration.Seconds(), 'g', -1, 64))
+			fmt.Fprintf(bw, "pgxwrapper_operation_duration_seconds_count{%s} %d\n", labels, m.count)
+		}
+	}
+
+	return bw.Flush()
+}
+
+// labelEscaper экранирует значения меток по правилам текстового формата Prometheus
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// labels возвращает метки операции в текстовом формате Prometheus
+func (k operationKey) labels() string {
+	return `role="` + labelEscaper.Replace(k.role) + `",operation="` + labelEscaper.Replace(k.operation) + `"`
+}
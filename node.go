@@ -0,0 +1,116 @@
+package pgxwrapper
+
+import (
+	"sync"
+	"sync/atomic"
+
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// node узел кластера (мастер или реплика) со своим пулом подключений
+type node struct {
+	// name имя узла для логов
+	name string
+
+	// pool пул подключений к узлу
+	pool *pgxpool.Pool
+
+	// replicaType тип реплики; для мастера не используется
+	replicaType ReplicaType
+
+	// isMaster признак мастера
+	isMaster bool
+
+	// index номер узла в конфигурации (см. ReplicaInfo.Index)
+	index int
+
+	// inFlight количество операций, выполняющихся на узле в данный момент
+	inFlight atomic.Int64
+
+	// health состояние узла и автоматический выключатель
+	health nodeHealth
+
+	// replMu защищает replication
+	replMu sync.RWMutex
+
+	// replication состояние репликации по результатам последней проверки
+	replication replicationState
+}
+
+// inFlightSlot учет операции в количестве выполняющихся на узле (node.inFlight).
+// Query и QueryRow удерживают его до закрытия Rows или вызова Scan, чтобы
+// долгое чтение строк учитывалось балансировщиком
+type inFlightSlot struct {
+	n *node
+
+	// held признак того, что освобождение передано результату операции
+	held bool
+
+	once sync.Once
+}
+
+// acquireSlot учитывает новую операцию на узле
+func (n *node) acquireSlot() *inFlightSlot {
+	n.inFlight.Add(1)
+	return &inFlightSlot{n: n}
+}
+
+// hold передает освобождение слота результату операции и возвращает функцию освобождения
+func (s *inFlightSlot) hold() func() {
+	if s == nil {
+		return func() {}
+	}
+	s.held = true
+	return s.release
+}
+
+// release завершает учет операции. Повторные вызовы ничего не делают
+func (s *inFlightSlot) release() {
+	s.once.Do(func() { s.n.inFlight.Add(-1) })
+}
+
+// conn возвращает подключение к узлу с учетом его роли.
+// Ожидание переподключения включается для мастера и для реплик без переключения:
+// при доступном переключении ошибка реплики быстрее обрабатывается следующим узлом
+func (n *node) conn(db *DB) Conn {
+	return n.connAt(db, fallbackPosition{}, nil)
+}
+
+// connAt возвращает подключение к узлу для операции, выполняемой в положении position
+// повторных попыток и переключения между узлами и учтенной в slot
+func (n *node) connAt(db *DB, position fallbackPosition, slot *inFlightSlot) Conn {
+	if n.isMaster {
+		return &masterConn{conn: n.pool, db: db, role: roleMaster, name: n.name, position: position, slot: slot, reconnect: true, failover: len(db.hosts) > 0, ambient: true}
+	}
+	return &replicaConn{masterConn{conn: n.pool, db: db, role: n.role(), name: n.name, position: position, slot: slot, reconnect: !db.replicaFallback}, n.replicaType}
+}
+
+// getReplicationState возвращает состояние репликации узла
+func (n *node) getReplicationState() replicationState {
+	n.replMu.RLock()
+	defer n.replMu.RUnlock()
+	return n.replication
+}
+
+// setReplicationState сохраняет состояние репликации узла
+func (n *node) setReplicationState(state replicationState) {
+	n.replMu.Lock()
+	defer n.replMu.Unlock()
+	n.replication = state
+}
+
+// advanceReplayLSN обновляет известную позицию применения WAL, если она выросла
+func (n *node) advanceReplayLSN(lsn LSN) {
+	n.replMu.Lock()
+	defer n.replMu.Unlock()
+	if lsn > n.replication.replayLSN {
+		n.replication.replayLSN = lsn
+	}
+}
+
+// close закрывает пул подключений узла
+func (n *node) close() {
+	if n != nil && n.pool != nil {
+		n.pool.Close()
+	}
+}
@@ -0,0 +1,287 @@
+package pgxwrapper
+
+import (
+	"strings"
+)
+
+// sanitizeSQL заменяет строковые и числовые литералы в SQL запросе на "?",
+// чтобы значения не попадали в трассировку. Идентификаторы, параметры $N и комментарии
+// сохраняются
+func sanitizeSQL(sql string) string {
+	return normalizeSQL(sql, false)
+}
+
+// FingerprintSQL возвращает отпечаток SQL запроса: литералы и параметры $N заменяются
+// на "?", комментарии удаляются, пробельные символы схлопываются, а списки IN (?, ?, ...)
+// любой длины заменяются на IN (...). Запросы, отличающиеся только значениями,
+// получают одинаковый отпечаток, по которому Telemetry собирает статистику запросов
+func FingerprintSQL(sql string) string {
+	return collapseInLists(normalizeSQL(sql, true))
+}
+
+// normalizeSQL заменяет литералы в SQL запросе на "?". При fingerprint также заменяются
+// параметры $N, удаляются комментарии и схлопываются пробельные символы
+func normalizeSQL(sql string, fingerprint bool) string {
+	var b strings.Builder
+	b.Grow(len(sql))
+
+	// space записывает пробел вместо пробельных символов и комментариев при построении отпечатка
+	space := func() {
+		if b.Len() > 0 && !strings.HasSuffix(b.String(), " ") {
+			b.WriteByte(' ')
+		}
+	}
+
+	for i := 0; i < len(sql); {
+		c := sql[i]
+		switch {
+		case c == '-' && i+1 < len(sql) && sql[i+1] == '-':
+			end := strings.IndexByte(sql[i:], '\n')
+			if end < 0 {
+				end = len(sql) - i
+			}
+			if fingerprint {
+				space()
+			} else {
+				b.WriteString(sql[i : i+end])
+			}
+			i += end
+
+		case c == '/' && i+1 < len(sql) && sql[i+1] == '*':
+			end := strings.Index(sql[i+2:], "*/")
+			if end < 0 {
+				end = len(sql) - i
+			} else {
+				end += 4
+			}
+			if fingerprint {
+				space()
+			} else {
+				b.WriteString(sql[i : i+end])
+			}
+			i += end
+
+		case fingerprint && (c == ' ' || c == '\t' || c == '\n' || c == '\r'):
+			space()
+			i++
+
+		case c == '"':
+			end := quotedEnd(sql, i, '"', false)
+			b.WriteString(sql[i:end])
+			i = end
+
+		case c == '\'':
+			b.WriteByte('?')
+			i = quotedEnd(sql, i, '\'', false)
+
+		case (c == 'E' || c == 'e') && i+1 < len(sql) && sql[i+1] == '\'' && !identByte(prevByte(sql, i)):
+			b.WriteByte('?')
+			i = quotedEnd(sql, i+1, '\'', true)
+
+		case c == '$' && !identByte(prevByte(sql, i)):
+			if end, ok := dollarQuotedEnd(sql, i); ok {
+				b.WriteByte('?')
+				i = end
+				break
+			}
+			end := i + 1
+			for end < len(sql) && isDigit(sql[end]) {
+				end++
+			}
+			if fingerprint && end > i+1 {
+				b.WriteByte('?')
+			} else {
+				// Параметр $N сохраняется вместе с номером
+				b.WriteString(sql[i:end])
+			}
+			i = end
+
+		case isDigit(c) && !identByte(prevByte(sql, i)),
+			c == '.' && i+1 < len(sql) && isDigit(sql[i+1]) && !identByte(prevByte(sql, i)):
+			b.WriteByte('?')
+			i = numberEnd(sql, i)
+
+		case identByte(c):
+			end := i + 1
+			for end < len(sql) && identByte(sql[end]) {
+				end++
+			}
+			b.WriteString(sql[i:end])
+			i = end
+
+		default:
+			b.WriteByte(c)
+			i++
+		}
+	}
+
+	if fingerprint {
+		return strings.TrimSpace(b.String())
+	}
+	return b.String()
+}
+
+// collapseInLists заменяет списки значений IN (?, ?, ...) в нормализованном запросе на IN (...)
+func collapseInLists(sql string) string {
+	var b strings.Builder
+	b.Grow(len(sql))
+
+	for i := 0; i < len(sql); {
+		c := sql[i]
+		switch {
+		case c == '"':
+			end := quotedEnd(sql, i, '"', false)
+			b.WriteString(sql[i:end])
+			i = end
+
+		case (c|0x20 == 'i') && i+1 < len(sql) && (sql[i+1]|0x20 == 'n') && !identByte(prevByte(sql, i)) &&
+			(i+2 == len(sql) || !identByte(sql[i+2])):
+			if end, ok := inListEnd(sql, i+2); ok {
+				b.WriteString(sql[i:i+2] + " (...)")
+				i = end
+				break
+			}
+			b.WriteString(sql[i : i+2])
+			i += 2
+
+		case identByte(c):
+			end := i + 1
+			for end < len(sql) && identByte(sql[end]) {
+				end++
+			}
+			b.WriteString(sql[i:end])
+			i = end
+
+		default:
+			b.WriteByte(c)
+			i++
+		}
+	}
+
+	return b.String()
+}
+
+// inListEnd возвращает позицию после списка " (?, ?, ...)", начинающегося в start
+func inListEnd(sql string, start int) (int, bool) {
+	i := start
+	if i < len(sql) && sql[i] == ' ' {
+		i++
+	}
+	if i >= len(sql) || sql[i] != '(' {
+		return 0, false
+	}
+
+	values := 0
+	for i++; i < len(sql); i++ {
+		switch sql[i] {
+		case '?':
+			values++
+		case ',', ' ':
+		case ')':
+			return i + 1, values > 0
+		default:
+			return 0, false
+		}
+	}
+	return 0, false
+}
+
+// quotedEnd возвращает позицию после закрывающей кавычки строки, начинающейся в start.
+// Удвоенная кавычка считается частью строки, при escapes также учитывается экранирование "\"
+func quotedEnd(sql string, start int, quote byte, escapes bool) int {
+	for i := start + 1; i < len(sql); i++ {
+		switch {
+		case escapes && sql[i] == '\\':
+			i++
+		case sql[i] == quote:
+			if i+1 < len(sql) && sql[i+1] == quote {
+				i++
+				continue
+			}
+			return i + 1
+		}
+	}
+	return len(sql)
+}
+
+// dollarQuotedEnd возвращает позицию после строки в долларовых кавычках ($tag$...$tag$),
+// начинающейся в start
+func dollarQuotedEnd(sql string, start int) (int, bool) {
+	tagEnd := start + 1
+	for tagEnd < len(sql) && sql[tagEnd] != '$' {
+		if !identByte(sql[tagEnd]) || (tagEnd == start+1 && isDigit(sql[tagEnd])) {
+			return 0, false
+		}
+		tagEnd++
+	}
+	if tagEnd >= len(sql) {
+		return 0, false
+	}
+
+	tag := sql[start : tagEnd+1]
+	end := strings.Index(sql[tagEnd+1:], tag)
+	if end < 0 {
+		return len(sql), true
+	}
+	return tagEnd + 1 + end + len(tag), true
+}
+
+// numberEnd возвращает позицию после числового литерала, начинающегося в start
+func numberEnd(sql string, start int) int {
+	i := start
+	for i < len(sql) && (isDigit(sql[i]) || sql[i] == '.' || sql[i] == '_') {
+		i++
+	}
+	if i < len(sql) && (sql[i] == 'e' || sql[i] == 'E') {
+		j := i + 1
+		if j < len(sql) && (sql[j] == '+' || sql[j] == '-') {
+			j++
+		}
+		if j < len(sql) && isDigit(sql[j]) {
+			i = j
+			for i < len(sql) && isDigit(sql[i]) {
+				i++
+			}
+		}
+	}
+	return i
+}
+
+// prevByte возвращает байт перед позицией i или 0 в начале строки
+func prevByte(sql string, i int) byte {
+	if i == 0 {
+		return 0
+	}
+	return sql[i-1]
+}
+
+// identByte проверяет, может ли байт входить в идентификатор
+func identByte(c byte) bool {
+	return c == '_' || c == '$' || isDigit(c) || (c|0x20 >= 'a' && c|0x20 <= 'z') || c >= 0x80
+}
+
+// isDigit проверяет, является ли байт цифрой
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
+
+// singleStatement проверяет, что sql содержит ровно одну команду: точка с запятой
+// допускается только в конце запроса, вне строк, идентификаторов в кавычках и комментариев
+func singleStatement(sql string) bool {
+	normalized := strings.TrimRight(normalizeSQL(sql, true), "; ")
+	if normalized == "" {
+		return false
+	}
+
+	for i := 0; i < len(normalized); {
+		switch normalized[i] {
+		case '"':
+			i = quotedEnd(normalized, i, '"', false)
+		case ';':
+			return false
+		default:
+			i++
+		}
+	}
+	return true
+}
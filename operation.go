@@ -0,0 +1,212 @@
+package pgxwrapper
+
+import (
+	"context"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// OperationKind вид операции драйвера
+type OperationKind string
+
+const (
+	// OperationExec выполнение команды (Exec)
+	OperationExec OperationKind = "exec"
+
+	// OperationQuery выполнение запроса (Query)
+	OperationQuery OperationKind = "query"
+
+	// OperationQueryRow выполнение запроса одной строки (QueryRow)
+	OperationQueryRow OperationKind = "query_row"
+
+	// OperationBegin начало транзакции (Begin, BeginTx)
+	OperationBegin OperationKind = "begin"
+
+	// OperationCommit фиксация транзакции
+	OperationCommit OperationKind = "commit"
+
+	// OperationRollback откат транзакции
+	OperationRollback OperationKind = "rollback"
+
+	// OperationBatch отправка пакета запросов (SendBatch); завершается при закрытии BatchResults
+	OperationBatch OperationKind = "batch"
+
+	// OperationCopyFrom загрузка строк командой COPY FROM (CopyFrom)
+	OperationCopyFrom OperationKind = "copy_from"
+
+	// OperationCopyTo выгрузка командой COPY TO (CopyTo)
+	OperationCopyTo OperationKind = "copy_to"
+)
+
+// Operation операция драйвера на конкретном узле, передаваемая перехватчикам
+type Operation struct {
+	// Kind вид операции
+	Kind OperationKind
+
+	// SQL текст запроса; пустой для Begin, Commit и Rollback.
+	// Перехватчик может изменить его в Before, например добавить комментарий.
+	// Для SendBatch - запросы пакета через "; ", для CopyFrom - команда COPY FROM STDIN;
+	// для них изменение не применяется
+	SQL string
+
+	// Args аргументы запроса. Перехватчик может изменить их в Before; для SendBatch и COPY не заполняются
+	Args []any
+
+	// Role роль узла: master, sync или async
+	Role string
+
+	// Node имя узла
+	Node string
+
+	// CommandTag результат выполнения Exec, Query, CopyFrom или CopyTo; заполняется перед вызовом After
+	CommandTag pgconn.CommandTag
+
+	// Err ошибка операции; заполняется перед вызовом After
+	Err error
+
+	// Duration длительность операции без учета перехватчиков; заполняется перед вызовом After.
+	// Для Query включает чтение строк: операция завершается после последней строки или при закрытии Rows
+	Duration time.Duration
+}
+
+// Interceptor перехватчик операций драйвера. Вызывается для каждой операции на узле,
+// в том числе для каждой повторной попытки и каждого узла при переключении между репликами.
+// Перехватчики из Config.Interceptors вызываются в порядке перечисления в Before
+// и в обратном порядке в After
+type Interceptor interface {
+	// Before вызывается перед операцией и возвращает контекст, в котором она будет выполнена.
+	// Ошибка отменяет операцию и возвращается вызывающему коду
+	Before(ctx context.Context, op *Operation) (context.Context, error)
+
+	// After вызывается после операции, если Before этого перехватчика завершился без ошибки
+	After(ctx context.Context, op *Operation)
+}
+
+// InterceptorFuncs перехватчик из функций. Незаданные функции пропускаются
+type InterceptorFuncs struct {
+	BeforeFunc func(ctx context.Context, op *Operation) (context.Context, error)
+	AfterFunc  func(ctx context.Context, op *Operation)
+}
+
+// Before вызывает BeforeFunc, если она задана
+func (f InterceptorFuncs) Before(ctx context.Context, op *Operation) (context.Context, error) {
+	if f.BeforeFunc == nil {
+		return ctx, nil
+	}
+	return f.BeforeFunc(ctx, op)
+}
+
+// After вызывает AfterFunc, если она задана
+func (f InterceptorFuncs) After(ctx context.Context, op *Operation) {
+	if f.AfterFunc != nil {
+		f.AfterFunc(ctx, op)
+	}
+}
+
+// trackedOperation выполняющаяся операция драйвера: учитывается в телеметрии,
+// трассировке и передается перехватчикам
+type trackedOperation struct {
+	Operation
+
+	db *DB
+
+	// ctx контекст операции для вызова After
+	ctx context.Context
+
+	// intercepted количество перехватчиков, для которых выполнен Before
+	intercepted int
+
+	// pool пул узла, на котором выполняется операция вне транзакции; используется
+	// для получения плана медленного запроса
+	pool *pgxpool.Pool
+
+	start time.Time
+	done  func(err error)
+	span  Span
+}
+
+// startOperation вызывает перехватчики и начинает учет операции op в телеметрии и трассировке.
+// Возвращает контекст, в котором нужно выполнить операцию, и ошибку перехватчика,
+// если операция отменена. SQL и аргументы операции нужно брать из результата,
+// так как перехватчики могут их изменить
+func (db *DB) startOperation(ctx context.Context, op Operation, position fallbackPosition) (context.Context, *trackedOperation, error) {
+	o := &trackedOperation{Operation: op, db: db}
+
+	for _, interceptor := range db.config.Interceptors {
+		next, err := interceptor.Before(ctx, &o.Operation)
+		if err != nil {
+			o.Err = err
+			o.after(ctx)
+			return ctx, nil, err
+		}
+		ctx = next
+		o.intercepted++
+	}
+
+	ctx, o.span = db.startSpan(ctx, operationSpans[op.Kind], o.SQL)
+	o.span.SetAttributes(append(position.attributes(), Attribute{Key: AttrNodeRole, Value: op.Role})...)
+	o.ctx = ctx
+	o.done = db.telemetry.startOperation(op.Role, string(op.Kind))
+	o.start = time.Now()
+	return ctx, o, nil
+}
+
+// setResult записывает результат выполнения команды
+func (o *trackedOperation) setResult(tag pgconn.CommandTag) {
+	o.CommandTag = tag
+	o.span.SetAttributes(Attribute{Key: AttrRowsAffected, Value: tag.RowsAffected()})
+}
+
+// end завершает учет операции и вызывает After перехватчиков
+func (o *trackedOperation) end(err error) {
+	o.Duration = time.Since(o.start)
+	o.Err = err
+	o.done(err)
+	o.db.telemetry.recordStatement(o.SQL, o.Duration, o.rows(err), err)
+	endSpan(o.span, err)
+	if o.db.isSlow(o.Duration) {
+		o.db.logSlowQuery(o.ctx, o)
+	}
+	o.after(o.ctx)
+}
+
+// endRows завершает операцию Query, когда строки прочитаны или Rows закрыт: длительность
+// включает выполнение запроса и чтение строк, а ошибка - ошибки, полученные при чтении
+func (o *trackedOperation) endRows(tag pgconn.CommandTag, err error) {
+	o.setResult(tag)
+	o.end(err)
+}
+
+// rows возвращает количество строк, измененных командой, прочитанных запросом или переданных COPY
+func (o *trackedOperation) rows(err error) int64 {
+	if o.Kind == OperationQueryRow {
+		if err == nil {
+			return 1
+		}
+		return 0
+	}
+	return o.CommandTag.RowsAffected()
+}
+
+// after вызывает After перехватчиков, для которых выполнен Before, в обратном порядке
+func (o *trackedOperation) after(ctx context.Context) {
+	for i := o.intercepted - 1; i >= 0; i-- {
+		o.db.config.Interceptors[i].After(ctx, &o.Operation)
+	}
+}
+
+// startOperation начинает операцию kind на узле подключения
+func (mc *masterConn) startOperation(ctx context.Context, kind OperationKind, sql string, args []any) (context.Context, *trackedOperation, error) {
+	ctx, op, err := mc.db.startOperation(ctx, Operation{Kind: kind, SQL: sql, Args: args, Role: mc.role, Node: mc.name}, mc.position)
+	if op != nil {
+		op.pool = mc.conn
+	}
+	return ctx, op, err
+}
+
+// startOperation начинает операцию kind на узле транзакции
+func (t *txWrapper) startOperation(ctx context.Context, kind OperationKind, sql string, args []any) (context.Context, *trackedOperation, error) {
+	return t.db.startOperation(ctx, Operation{Kind: kind, SQL: sql, Args: args, Role: t.role, Node: t.node}, fallbackPosition{})
+}
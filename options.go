@@ -2,7 +2,10 @@ package pgxwrapper
 
 import (
 	"context"
+	"io"
 	"log/slog"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/jackc/pgx/v5"
@@ -20,25 +23,138 @@ type Config struct {
 	// AsyncSlaveConnString строка подключения к асинхронной реплике
 	AsyncSlaveConnString string
 
+	// AsyncSlaveConnStrings строки подключения к асинхронным репликам.
+	// Используются вместе с AsyncSlaveConnString, если она задана
+	AsyncSlaveConnStrings []string
+
+	// Balancer стратегия распределения запросов между асинхронными репликами.
+	// По умолчанию используется NewRoundRobinBalancer
+	Balancer Balancer
+
+	// Hosts адреса узлов кластера (host или host:port) для автоматического определения ролей.
+	// Если задан, параметры подключения берутся из MasterConnString, мастер определяется
+	// по pg_is_in_recovery(), синхронная реплика - по pg_stat_replication, остальные узлы
+	// считаются асинхронными репликами. SyncSlaveConnString и AsyncSlaveConnStrings игнорируются
+	Hosts []string
+
+	// TopologyCheckInterval интервал перепроверки ролей узлов из Hosts. По умолчанию 10 секунд
+	TopologyCheckInterval time.Duration
+
+	// MasterPool параметры пула подключений к мастеру (при заданном Hosts - к каждому узлу)
+	MasterPool PoolConfig
+
+	// SyncSlavePool параметры пула подключений к синхронной реплике
+	SyncSlavePool PoolConfig
+
+	// AsyncSlavePool параметры пула подключений к каждой асинхронной реплике
+	AsyncSlavePool PoolConfig
+
 	// MaxRetries максимальное количество повторных попыток при ошибках
 	MaxRetries int
 
 	// RetryDelay задержка между повторными попытками
 	RetryDelay time.Duration
 
+	// RetryPolicy стратегия задержек между повторными попытками и общий бюджет времени.
+	// По умолчанию постоянная задержка RetryDelay
+	RetryPolicy RetryPolicy
+
+	// ErrorClassifier определяет класс ошибки для решения о повторной попытке
+	// и переключении на другой узел. По умолчанию используется ClassifyError
+	ErrorClassifier func(err error) ErrorClass
+
 	// QueryTimeout таймаут для выполнения запросов
 	QueryTimeout time.Duration
 
+	// ReconnectTimeout время, в течение которого операции на мастере (и на репликах при
+	// отключенном переключении) повторяются с растущей задержкой при потере подключения,
+	// например при перезапуске PostgreSQL.
+	// 0 - без ожидания: разорванные подключения заменяются пулом при следующем обращении
+	ReconnectTimeout time.Duration
+
 	// EnableTelemetry включить телеметрию
 	EnableTelemetry bool
 
+	// MaxReplicationLag максимально допустимое отставание реплики.
+	// Реплики с большим отставанием не используются для чтения. 0 - без ограничения
+	MaxReplicationLag time.Duration
+
+	// ReplicationLagCheckInterval интервал проверки отставания реплик.
+	// По умолчанию 5 секунд
+	ReplicationLagCheckInterval time.Duration
+
+	// HealthCheckInterval интервал фоновой проверки доступности узлов (Ping).
+	// 0 - фоновая проверка отключена, состояние узлов определяется по ошибкам запросов
+	HealthCheckInterval time.Duration
+
+	// CircuitBreakerThreshold количество ошибок подключения подряд, после которого
+	// запросы перестают направляться на узел. По умолчанию 3
+	CircuitBreakerThreshold int
+
+	// CircuitBreakerCooldown время, через которое на недоступный узел
+	// направляется пробный запрос. По умолчанию 30 секунд
+	CircuitBreakerCooldown time.Duration
+
+	// CaptureCommitLSN запоминать позицию WAL мастера после каждой фиксации изменений
+	// (Exec, Query, QueryRow, SendBatch и CopyFrom на мастере и Commit транзакции), см. DB.LastCommitLSN
+	CaptureCommitLSN bool
+
+	// ReadYourWritesTimeout максимальное время ожидания применения LSN из контекста (WithLSN)
+	// на репликах, после которого чтение выполняется на мастере
+	ReadYourWritesTimeout time.Duration
+
 	// DisableReplicaFallback отключить переключение между репликами
 	DisableReplicaFallback bool
 
+	// BufferReplicaQueries полностью читать результаты Query на репликах внутри повторных попыток,
+	// чтобы обрыв подключения во время чтения строк приводил к повтору на следующем узле
+	BufferReplicaQueries bool
+
+	// MaxBufferedRows максимальное количество строк буферизованного результата (по умолчанию 10000)
+	MaxBufferedRows int
+
+	// MaxBufferedBytes максимальный размер значений буферизованного результата в байтах (по умолчанию 16 МиБ)
+	MaxBufferedBytes int64
+
+	// Tracer создает спаны для операций драйвера. Повторные попытки и переключения между
+	// репликами становятся дочерними спанами логического вызова
+	Tracer Tracer
+
+	// SanitizeTracedSQL заменять литералы в SQL запросах, записываемых в спаны, на "?"
+	SanitizeTracedSQL bool
+
+	// Interceptors перехватчики операций Exec, Query, QueryRow, Begin, Commit, Rollback, SendBatch,
+	// CopyFrom и CopyTo на узлах и в транзакциях
+	Interceptors []Interceptor
+
+	// SlowQueryThreshold длительность операции, начиная с которой она записывается в лог
+	// как медленная (уровень Warn). 0 - лог медленных запросов отключен
+	SlowQueryThreshold time.Duration
+
+	// SlowQueryExplainRate доля медленных запросов (от 0 до 1), для которых на том же узле
+	// запрашивается план EXPLAIN (FORMAT JSON) и добавляется к записи лога. 0 - без плана
+	SlowQueryExplainRate float64
+
 	// Logger логгер для драйвера
 	Logger *slog.Logger
 }
 
+// PoolConfig параметры пула подключений для одной роли (мастер или реплика).
+// Нулевые значения означают использование значений по умолчанию pgxpool
+type PoolConfig struct {
+	// MaxConns максимальное количество подключений в пуле
+	MaxConns int32
+
+	// MinConns минимальное количество подключений, поддерживаемых в пуле
+	MinConns int32
+
+	// MaxConnLifetime максимальное время жизни подключения
+	MaxConnLifetime time.Duration
+
+	// MaxConnIdleTime максимальное время простоя подключения
+	MaxConnIdleTime time.Duration
+}
+
 // Conn интерфейс подключения к базе данных
 type Conn interface {
 	Exec(ctx context.Context, sql string, arguments ...any) (pgconn.CommandTag, error)
@@ -48,16 +164,26 @@ type Conn interface {
 	BeginTx(ctx context.Context, txOptions TxOptions) (Tx, error)
 	Ping(ctx context.Context) error
 	Close(ctx context.Context) error
+	SendBatch(ctx context.Context, b *Batch) BatchResults
+	CopyFrom(ctx context.Context, tableName pgx.Identifier, columnNames []string, rowSrc pgx.CopyFromSource) (int64, error)
+	CopyTo(ctx context.Context, sql string, w io.Writer) (pgconn.CommandTag, error)
 }
 
-// Rows интерфейс для результата запроса
+// Rows интерфейс для результата запроса. Включает все методы pgx.Rows, поэтому результат
+// можно передавать в pgx.CollectRows, pgx.ForEachRow и функции pgx.RowToFunc
 type Rows interface {
 	Close()
 	Err() error
 	Next() bool
 	Scan(dest ...any) error
 	Values() ([]any, error)
+	// ColumnTypes возвращает описания столбцов в виде []any.
+	// Deprecated: используйте FieldDescriptions
 	ColumnTypes() []any
+	FieldDescriptions() []pgconn.FieldDescription
+	CommandTag() pgconn.CommandTag
+	RawValues() [][]byte
+	Conn() *pgx.Conn
 }
 
 // Row интерфейс для одной строки результата
@@ -65,6 +191,20 @@ type Row interface {
 	Scan(dest ...any) error
 }
 
+// Batch набор запросов, отправляемых на сервер за один обмен
+type Batch struct {
+	pgx.Batch
+}
+
+// BatchResults интерфейс для результатов пакета запросов.
+// Результаты читаются в порядке добавления запросов в Batch, Close обязателен
+type BatchResults interface {
+	Exec() (pgconn.CommandTag, error)
+	Query() (Rows, error)
+	QueryRow() Row
+	Close() error
+}
+
 // TxOptions параметры транзакции
 type TxOptions struct {
 	// TODO: определить параметры транзакции
@@ -80,9 +220,24 @@ type Tx interface {
 
 // DB основной драйвер
 type DB struct {
-	master     *pgx.Conn
-	syncSlave  *pgx.Conn
-	asyncSlave *pgx.Conn
+	master      *node
+	syncSlave   *node
+	asyncSlaves []*node
+
+	// topologyMu защищает распределение узлов по ролям
+	topologyMu sync.RWMutex
+
+	// hosts узлы кластера из Config.Hosts
+	hosts []*clusterHost
+
+	// discoveryMu не дает выполнять несколько проверок ролей одновременно
+	discoveryMu sync.Mutex
+
+	// topologyRefresh запросы внеочередной проверки ролей узлов
+	topologyRefresh chan struct{}
+
+	// balancer стратегия выбора асинхронной реплики
+	balancer Balancer
 
 	config Config
 
@@ -94,4 +249,23 @@ type DB struct {
 
 	// logger логгер
 	logger *slog.Logger
+
+	// explainRunning признак выполняющегося запроса плана медленного запроса.
+	// Одновременно запрашивается не более одного плана
+	explainRunning atomic.Bool
+
+	// lastCommitLSN наибольшая позиция WAL мастера, полученная после фиксации изменений
+	lastCommitLSN atomic.Uint64
+
+	// backgroundCtx контекст фоновых задач, отменяется при закрытии драйвера
+	backgroundCtx context.Context
+
+	// stopBackground останавливает фоновые задачи драйвера
+	stopBackground context.CancelFunc
+
+	// background ожидание завершения фоновых задач
+	background sync.WaitGroup
+
+	// backgroundMu не дает запускать фоновые задачи после начала закрытия драйвера
+	backgroundMu sync.Mutex
 }
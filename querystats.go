@@ -0,0 +1,190 @@
+package pgxwrapper
+
+import (
+	"errors"
+	"math"
+	"slices"
+	"sort"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+)
+
+const (
+	// maxQueryFingerprints максимальное количество отпечатков запросов в статистике.
+	// Запросы с новыми отпечатками сверх этого количества учитываются в otherQueriesFingerprint
+	maxQueryFingerprints = 1000
+
+	// otherQueriesFingerprint отпечаток, под которым учитываются запросы сверх maxQueryFingerprints
+	otherQueriesFingerprint = "<other>"
+
+	// queryLatencySamples количество последних длительностей запроса, по которым
+	// рассчитываются перцентили
+	queryLatencySamples = 512
+
+	// maxCachedFingerprintSQL максимальная длина запроса, отпечаток которого кешируется.
+	// Длинные запросы обычно собраны конкатенацией с литералами и не повторяются,
+	// а их текст в ключах кеша занимал бы память
+	maxCachedFingerprintSQL = 1024
+)
+
+// QueryStats статистика запросов с одинаковым отпечатком (см. FingerprintSQL)
+type QueryStats struct {
+	// Fingerprint отпечаток запроса
+	Fingerprint string
+
+	// Calls количество выполнений
+	Calls int64
+
+	// Errors количество выполнений, завершившихся ошибкой. pgx.ErrNoRows ошибкой не считается
+	Errors int64
+
+	// Rows количество строк, измененных командами или прочитанных запросами
+	Rows int64
+
+	// TotalDuration суммарная длительность выполнений
+	TotalDuration time.Duration
+
+	// P50, P95, P99 перцентили длительности по последним выполнениям (до 512)
+	P50 time.Duration
+	P95 time.Duration
+	P99 time.Duration
+}
+
+// queryStats накопленная статистика запросов с одинаковым отпечатком
+type queryStats struct {
+	calls    int64
+	errors   int64
+	rows     int64
+	duration time.Duration
+
+	// samples кольцевой буфер последних длительностей, next - позиция следующей записи
+	samples []time.Duration
+	next    int
+}
+
+// addSample записывает длительность выполнения в кольцевой буфер
+func (s *queryStats) addSample(duration time.Duration) {
+	if len(s.samples) < queryLatencySamples {
+		s.samples = append(s.samples, duration)
+		return
+	}
+	s.samples[s.next] = duration
+	s.next = (s.next + 1) % queryLatencySamples
+}
+
+// fingerprint возвращает отпечаток запроса, запоминая отпечатки коротких запросов
+// для повторных вызовов
+func (t *Telemetry) fingerprint(sql string) string {
+	if len(sql) > maxCachedFingerprintSQL {
+		return FingerprintSQL(sql)
+	}
+
+	t.fingerprintMu.RLock()
+	fingerprint, ok := t.fingerprints[sql]
+	t.fingerprintMu.RUnlock()
+	if ok {
+		return fingerprint
+	}
+
+	fingerprint = FingerprintSQL(sql)
+
+	t.fingerprintMu.Lock()
+	defer t.fingerprintMu.Unlock()
+	if t.fingerprints == nil {
+		t.fingerprints = make(map[string]string)
+	}
+	// Кеш ограничен, чтобы запросы с литералами в тексте не увеличивали его бесконечно
+	if len(t.fingerprints) < maxQueryFingerprints*4 {
+		t.fingerprints[sql] = fingerprint
+	}
+	return fingerprint
+}
+
+// queryStatsLocked возвращает статистику запросов с отпечатком fingerprint,
+// создавая ее при необходимости. Вызывается под блокировкой t.mu
+func (t *Telemetry) queryStatsLocked(fingerprint string) *queryStats {
+	if t.queries == nil {
+		t.queries = make(map[string]*queryStats)
+	}
+
+	stats, ok := t.queries[fingerprint]
+	if !ok {
+		if len(t.queries) >= maxQueryFingerprints {
+			fingerprint = otherQueriesFingerprint
+			if stats, ok = t.queries[fingerprint]; ok {
+				return stats
+			}
+		}
+		stats = &queryStats{}
+		t.queries[fingerprint] = stats
+	}
+	return stats
+}
+
+// recordStatement учитывает выполнение запроса sql в статистике по отпечаткам
+func (t *Telemetry) recordStatement(sql string, duration time.Duration, rows int64, err error) {
+	if t == nil || sql == "" || !t.IsEnabled() {
+		return
+	}
+
+	// Отпечаток вычисляется до блокировки, чтобы нормализация длинных запросов
+	// не задерживала учет других операций
+	fingerprint := t.fingerprint(sql)
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	stats := t.queryStatsLocked(fingerprint)
+	stats.calls++
+	stats.rows += rows
+	stats.duration += duration
+	stats.addSample(duration)
+	if err != nil && !errors.Is(err, pgx.ErrNoRows) {
+		stats.errors++
+	}
+}
+
+// TopQueries возвращает статистику n запросов с наибольшей суммарной длительностью.
+// Запросы группируются по отпечатку FingerprintSQL. При n <= 0 возвращаются все запросы
+func (t *Telemetry) TopQueries(n int) []QueryStats {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	result := make([]QueryStats, 0, len(t.queries))
+	for fingerprint, stats := range t.queries {
+		samples := slices.Clone(stats.samples)
+		slices.Sort(samples)
+		result = append(result, QueryStats{
+			Fingerprint:   fingerprint,
+			Calls:         stats.calls,
+			Errors:        stats.errors,
+			Rows:          stats.rows,
+			TotalDuration: stats.duration,
+			P50:           percentile(samples, 0.50),
+			P95:           percentile(samples, 0.95),
+			P99:           percentile(samples, 0.99),
+		})
+	}
+
+	sort.Slice(result, func(i, j int) bool {
+		if result[i].TotalDuration != result[j].TotalDuration {
+			return result[i].TotalDuration > result[j].TotalDuration
+		}
+		return result[i].Fingerprint < result[j].Fingerprint
+	})
+
+	if n > 0 && n < len(result) {
+		result = result[:n]
+	}
+	return result
+}
+
+// percentile возвращает перцентиль p отсортированных длительностей методом ближайшего ранга
+func percentile(sorted []time.Duration, p float64) time.Duration {
+	if len(sorted) == 0 {
+		return 0
+	}
+	rank := int(math.Ceil(p*float64(len(sorted)))) - 1
+	return sorted[max(rank, 0)]
+}
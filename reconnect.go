@@ -0,0 +1,105 @@
+package pgxwrapper
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+const (
+	// reconnectInitialDelay начальная задержка между попытками переподключения
+	reconnectInitialDelay = 50 * time.Millisecond
+
+	// reconnectMaxDelay максимальная задержка между попытками переподключения
+	reconnectMaxDelay = 2 * time.Second
+)
+
+// reconnectable проверяет, можно ли повторить операцию на новом подключении.
+// Класс ошибки (Config.ErrorClassifier или ClassifyError) должен указывать на недоступность узла.
+// Кроме того, сервер не должен был выполнить запрос: сеанс завершен при остановке или запуске
+// сервера, подключение не удалось установить или запрос не был отправлен. Обрыв подключения
+// после отправки запроса не повторяется, так как запись могла быть применена
+func (db *DB) reconnectable(err error) bool {
+	class := db.classifyError(err)
+	if !class.NodeFailure() {
+		return false
+	}
+
+	var connectErr *pgconn.ConnectError
+	return class == ErrorClassShutdown || errors.As(err, &connectErr) || pgconn.SafeToRetry(err)
+}
+
+// withReconnect выполняет операцию и, если подключение к серверу было потеряно,
+// повторяет ее с экспоненциально растущей задержкой в пределах Config.ReconnectTimeout.
+// Пул заменяет разорванные подключения новыми при следующем обращении
+func (db *DB) withReconnect(ctx context.Context, operation func() error) error {
+	if db.config.ReconnectTimeout <= 0 {
+		return operation()
+	}
+
+	b := newBackoff(RetryPolicy{
+		Strategy:  BackoffExponential,
+		BaseDelay: reconnectInitialDelay,
+		MaxDelay:  reconnectMaxDelay,
+		Budget:    db.config.ReconnectTimeout,
+	})
+
+	for {
+		err := operation()
+		if err == nil || !db.reconnectable(err) {
+			return err
+		}
+
+		db.logger.WarnContext(ctx, "Подключение потеряно, повторная попытка", "error", err)
+		if db.telemetry != nil {
+			db.telemetry.RecordConnectionError()
+		}
+
+		if waitErr := b.wait(ctx); waitErr != nil {
+			return err
+		}
+	}
+}
+
+// reconnectingRow строка результата, запрос которой выполняется при вызове Scan,
+// чтобы его можно было повторить при потере подключения или смене мастера
+type reconnectingRow struct {
+	ctx  context.Context
+	mc   *masterConn
+	sql  string
+	args []any
+
+	// release завершает учет операции в количестве выполняющихся на узле
+	release func()
+}
+
+// Scan выполняет запрос и сканирует значения в переменные
+func (r *reconnectingRow) Scan(dest ...any) error {
+	if r.release != nil {
+		defer r.release()
+	}
+
+	ctx := r.ctx
+	if r.mc.db.config.QueryTimeout > 0 {
+		var cancel func()
+		ctx, cancel = context.WithTimeout(ctx, r.mc.db.config.QueryTimeout)
+		defer cancel()
+	}
+
+	ctx, op, err := r.mc.startOperation(ctx, OperationQueryRow, r.sql, r.args)
+	if err != nil {
+		return err
+	}
+
+	err = r.mc.withReconnect(ctx, func(pool *pgxpool.Pool) error {
+		return pool.QueryRow(ctx, op.SQL, op.Args...).Scan(dest...)
+	})
+	op.end(err)
+	if err == nil {
+		r.mc.captureCommitLSN(ctx)
+	}
+	return err
+}
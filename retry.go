@@ -4,14 +4,14 @@ import (
 	"context"
 	"errors"
 	"fmt"
-	"time"
-
-	"github.com/jackc/pgx/v5/pgconn"
 )
 
 // ReplicaManager менеджер реплик для обработки запросов с переключением между ними
 type ReplicaManager struct {
 	db *DB
+
+	// replicaType тип реплики, с которой начинается обход узлов
+	replicaType ReplicaType
 }
 
 // NewReplicaManager создает новый менеджер реплик
@@ -21,35 +21,114 @@ func NewReplicaManager(db *DB) *ReplicaManager {
 	}
 }
 
+// candidates возвращает узлы в порядке обхода:
+// асинхронные реплики в порядке балансировщика -> синхронная реплика -> мастер
+func (rm *ReplicaManager) candidates() []*node {
+	var nodes []*node
+	t := rm.db.currentTopology()
+
+	if rm.replicaType == AsyncReplica && len(t.asyncSlaves) > 0 {
+		replicas := make([]ReplicaInfo, len(t.asyncSlaves))
+		for i, n := range t.asyncSlaves {
+			replicas[i] = ReplicaInfo{Index: n.index, Name: n.name, InFlight: n.inFlight.Load()}
+		}
+		for _, i := range rm.db.balancer.Order(replicas) {
+			if i >= 0 && i < len(t.asyncSlaves) {
+				nodes = append(nodes, t.asyncSlaves[i])
+			}
+		}
+	}
+
+	if t.syncSlave != nil {
+		nodes = append(nodes, t.syncSlave)
+	}
+
+	if t.master != nil {
+		nodes = append(nodes, t.master)
+	}
+
+	return nodes
+}
+
+// execute выполняет операцию на узле с учетом количества выполняющихся операций
+// и обновляет состояние узла по ее результату
+func (rm *ReplicaManager) execute(ctx context.Context, n *node, position fallbackPosition, operation func(Conn) error) error {
+	slot := n.acquireSlot()
+	defer func() {
+		// Rows и Row освобождают слот сами после чтения результата
+		if !slot.held {
+			slot.release()
+		}
+	}()
+
+	err := operation(n.connAt(rm.db, position, slot))
+	rm.db.reportNodeResult(ctx, n, err)
+	return err
+}
+
 // ExecuteWithFallback выполняет операцию с переключением между репликами при ошибках
 func (rm *ReplicaManager) ExecuteWithFallback(ctx context.Context, operation func(Conn) error) error {
+	return rm.executeWithFallback(ctx, 1, operation)
+}
+
+// executeWithFallback выполняет попытку attempt логического вызова с переключением
+// между репликами. Номер попытки и узла передаются в трассировку операции на узле
+func (rm *ReplicaManager) executeWithFallback(ctx context.Context, attempt int, operation func(Conn) error) error {
+	nodes := rm.candidates()
+
 	if !rm.db.replicaFallback {
-		// Если отключено переключение между репликами, используем только асинхронную реплику
-		if rm.db.asyncSlave != nil {
-			conn := &replicaConn{masterConn{conn: rm.db.asyncSlave, db: rm.db}, AsyncReplica}
-			return operation(conn)
+		// Если отключено переключение между репликами, используем только первую реплику
+		if len(nodes) == 0 || nodes[0].isMaster {
+			return ErrNoAvailableReplicas
+		}
+		nodes = nodes[:1]
+
+		// Проверяем реплику до ожидания LSN, чтобы не опрашивать узел, который не примет запрос
+		if lag, exceeded := rm.db.replicationLagExceeded(nodes[0]); exceeded {
+			return fmt.Errorf("%w: %s replication lag %v", ErrReplicaNotReady, nodes[0].name, lag)
+		}
+		if rm.db.nodeUnavailable(nodes[0]) {
+			return fmt.Errorf("%w: %s is down", ErrNoAvailableReplicas, nodes[0].name)
 		}
-		return ErrNoAvailableReplicas
 	}
 
-	// Порядок попыток: AsyncSlave -> SyncSlave -> Master
-	connections := []struct {
-		conn        Conn
-		replicaType ReplicaType
-		name        string
-	}{
-		{&replicaConn{masterConn{conn: rm.db.asyncSlave, db: rm.db}, AsyncReplica}, AsyncReplica, "async slave"},
-		{&replicaConn{masterConn{conn: rm.db.syncSlave, db: rm.db}, SyncReplica}, SyncReplica, "sync slave"},
-		{&masterConn{conn: rm.db.master, db: rm.db}, -1, "master"},
+	// Для чтения своих записей оставляем только узлы, применившие LSN из контекста
+	if lsn, ok := LSNFromContext(ctx); ok {
+		var err error
+		nodes, err = rm.db.nodesReachedLSN(ctx, nodes, lsn)
+		if err != nil {
+			return err
+		}
+		if len(nodes) == 0 {
+			return fmt.Errorf("%w: replica has not replayed WAL up to %s", ErrReplicaNotReady, lsn)
+		}
+	}
+
+	if !rm.db.replicaFallback {
+		if !rm.db.nodeAvailable(nodes[0]) {
+			return fmt.Errorf("%w: %s is down", ErrNoAvailableReplicas, nodes[0].name)
+		}
+		return rm.execute(ctx, nodes[0], fallbackPosition{attempt: attempt}, operation)
 	}
 
 	var lastErr error
-	for _, connInfo := range connections {
-		if connInfo.conn == nil {
-			continue // Skipping unavailable connections
+	hop := 0
+	for _, n := range nodes {
+		// Пропускаем реплики, отставание которых превышает допустимое
+		if lag, exceeded := rm.db.replicationLagExceeded(n); exceeded {
+			rm.db.logger.DebugContext(ctx, fmt.Sprintf("Skipping %s due to replication lag", n.name), "lag", lag)
+			lastErr = fmt.Errorf("%w: %s replication lag %v", ErrReplicaNotReady, n.name, lag)
+			continue
+		}
+
+		// Пропускаем узлы с разомкнутым автоматическим выключателем
+		if !rm.db.nodeAvailable(n) {
+			rm.db.logger.DebugContext(ctx, fmt.Sprintf("Skipping %s, node is down", n.name))
+			continue
 		}
 
-		err := operation(connInfo.conn)
+		err := rm.execute(ctx, n, fallbackPosition{attempt: attempt, hop: hop}, operation)
+		hop++
 		if err == nil {
 			return nil // Операция выполнена успешно
 		}
@@ -59,13 +138,13 @@ func (rm *ReplicaManager) ExecuteWithFallback(ctx context.Context, operation fun
 			rm.db.telemetry.RecordError()
 		}
 
-		// Если ошибка не связана с подключением или таймаутом, не пытаемся на других репликах
-		if !isConnectionError(err) {
+		// Если ошибку не исправит повторная попытка, не пытаемся на других репликах
+		if !rm.db.classifyError(err).Retryable() {
 			return err
 		}
 
 		lastErr = err
-		rm.db.logger.InfoContext(ctx, fmt.Sprintf("Operation failed on %s, trying the next replica", connInfo.name), "error", err)
+		rm.db.logger.InfoContext(ctx, fmt.Sprintf("Operation failed on %s, trying the next replica", n.name), "error", err)
 	}
 
 	if lastErr != nil {
@@ -75,18 +154,22 @@ func (rm *ReplicaManager) ExecuteWithFallback(ctx context.Context, operation fun
 	return ErrNoAvailableReplicas
 }
 
-// ExecuteQueryWithRetry выполняет запрос с повторными попытками и переключением между репликами
+// ExecuteQueryWithRetry выполняет запрос с повторными попытками и переключением между репликами.
+// Задержка между попытками определяется Config.RetryPolicy, ожидание прерывается при отмене контекста
 func (rm *ReplicaManager) ExecuteQueryWithRetry(ctx context.Context, operation func(Conn) error) error {
 	var lastErr error
+	b := rm.db.newBackoff()
 
-	for attempt := 0; attempt <= rm.db.config.MaxRetries; attempt++ {
-		err := rm.ExecuteWithFallback(ctx, operation)
+	attempts := 0
+	for attempts <= rm.db.config.MaxRetries {
+		err := rm.executeWithFallback(ctx, attempts+1, operation)
+		attempts++
 		if err == nil {
 			return nil // Операция выполнена успешно
 		}
 
-		// Если ошибка не связана с подключением или таймаутом, не повторяем
-		if !isConnectionError(err) {
+		// Если ошибку не исправит повторная попытка, не повторяем
+		if !rm.db.classifyError(err).Retryable() {
 			return err
 		}
 
@@ -98,13 +181,18 @@ func (rm *ReplicaManager) ExecuteQueryWithRetry(ctx context.Context, operation f
 		}
 
 		// Если это не последняя попытка, ждем перед следующей
-		if attempt < rm.db.config.MaxRetries {
-			time.Sleep(rm.db.config.RetryDelay)
+		if attempts <= rm.db.config.MaxRetries {
+			if waitErr := b.wait(ctx); waitErr != nil {
+				if errors.Is(waitErr, errRetryBudgetExhausted) {
+					break
+				}
+				return fmt.Errorf("operation interrupted after %d attempts: %w: %w", attempts, waitErr, lastErr)
+			}
 		}
 	}
 
 	if lastErr != nil {
-		return fmt.Errorf("operation not performed after %d attempts: %w", rm.db.config.MaxRetries+1, lastErr)
+		return fmt.Errorf("operation not performed after %d attempts: %w", attempts, lastErr)
 	}
 
 	return ErrMaxRetriesExceeded
@@ -112,11 +200,19 @@ func (rm *ReplicaManager) ExecuteQueryWithRetry(ctx context.Context, operation f
 
 // ExecuteReadQueryWithFallback выполняет запрос на чтение с переключением между репликами
 func (rm *ReplicaManager) ExecuteReadQueryWithFallback(ctx context.Context, query string, args ...any) (Rows, error) {
+	return rm.executeReadQueryWithFallback(ctx, 1, query, args...)
+}
+
+// executeReadQueryWithFallback выполняет попытку attempt запроса на чтение с переключением между репликами
+func (rm *ReplicaManager) executeReadQueryWithFallback(ctx context.Context, attempt int, query string, args ...any) (Rows, error) {
 	var result Rows
 	var err error
 
-	err = rm.ExecuteWithFallback(ctx, func(conn Conn) error {
+	err = rm.executeWithFallback(ctx, attempt, func(conn Conn) error {
 		result, err = conn.Query(ctx, query, args...)
+		if err == nil && rm.db.config.BufferReplicaQueries {
+			result, err = rm.db.bufferRows(result)
+		}
 		return err
 	})
 
@@ -124,18 +220,23 @@ func (rm *ReplicaManager) ExecuteReadQueryWithFallback(ctx context.Context, quer
 }
 
 // ExecuteReadQueryWithRetry выполняет запрос на чтение с повторными попытками
-func (rm *ReplicaManager) ExecuteReadQueryWithRetry(ctx context.Context, query string, args ...any) (Rows, error) {
+func (rm *ReplicaManager) ExecuteReadQueryWithRetry(ctx context.Context, query string, args ...any) (rows Rows, err error) {
+	ctx, span := rm.db.startSpan(ctx, spanQuery, query)
+	defer func() { endSpan(span, err) }()
+
 	var result Rows
-	var err error
+	b := rm.db.newBackoff()
 
-	for attempt := 0; attempt <= rm.db.config.MaxRetries; attempt++ {
-		result, err = rm.ExecuteReadQueryWithFallback(ctx, query, args...)
+	attempts := 0
+	for attempts <= rm.db.config.MaxRetries {
+		result, err = rm.executeReadQueryWithFallback(ctx, attempts+1, query, args...)
+		attempts++
 		if err == nil {
 			return result, nil // Запрос выполнен успешно
 		}
 
-		// Если ошибка не связана с подключением или таймаутом, не повторяем
-		if !isConnectionError(err) {
+		// Если ошибку не исправит повторная попытка, не повторяем
+		if !rm.db.classifyError(err).Retryable() {
 			return nil, err
 		}
 
@@ -145,35 +246,15 @@ func (rm *ReplicaManager) ExecuteReadQueryWithRetry(ctx context.Context, query s
 		}
 
 		// Если это не последняя попытка, ждем перед следующей
-		if attempt < rm.db.config.MaxRetries {
-			time.Sleep(rm.db.config.RetryDelay)
-		}
-	}
-
-	return nil, fmt.Errorf("%w: read query not performed after %d attempts: %v", ErrMaxRetriesExceeded, rm.db.config.MaxRetries+1, err)
-}
-
-// isConnectionError проверяет, связана ли ошибка с подключением
-func isConnectionError(err error) bool {
-	if err == nil {
-		return false
-	}
-
-	if err.Error() == "connection refused" ||
-		err.Error() == "connection reset by peer" {
-		return true
-	}
-
-	var pgErr *pgconn.PgError
-	if errors.As(err, &pgErr) && pgErr != nil {
-		// Определенные коды ошибок PostgreSQL могут указывать на проблемы с подключением
-		switch pgErr.Code {
-		case "08001", // SQLSTATE connection failure
-			"08003", // SQLSTATE connection does not exist
-			"08006": // SQLSTATE connection failure
-			return true
+		if attempts <= rm.db.config.MaxRetries {
+			if waitErr := b.wait(ctx); waitErr != nil {
+				if errors.Is(waitErr, errRetryBudgetExhausted) {
+					break
+				}
+				return nil, fmt.Errorf("read query interrupted after %d attempts: %w: %w", attempts, waitErr, err)
+			}
 		}
 	}
 
-	return false
+	return nil, fmt.Errorf("%w: read query not performed after %d attempts: %v", ErrMaxRetriesExceeded, attempts, err)
 }
@@ -3,6 +3,7 @@ package pgxwrapper
 import (
 	"context"
 
+	"github.com/jackc/pgx/v5"
 	"github.com/jackc/pgx/v5/pgconn"
 )
 
@@ -12,28 +13,40 @@ type retryableConn struct {
 	manager *ReplicaManager
 }
 
-// Exec выполняет SQL команду с повторными попытками
+// Exec выполняет SQL команду с повторными попытками.
+// Спан логического вызова объединяет спаны всех попыток
 func (rc *retryableConn) Exec(ctx context.Context, sql string, arguments ...any) (pgconn.CommandTag, error) {
 	var result pgconn.CommandTag
 	var err error
 
+	ctx, span := rc.manager.db.startSpan(ctx, spanExec, sql)
 	err = rc.manager.ExecuteQueryWithRetry(ctx, func(conn Conn) error {
 		result, err = conn.Exec(ctx, sql, arguments...)
 		return err
 	})
+	if err == nil {
+		span.SetAttributes(Attribute{Key: AttrRowsAffected, Value: result.RowsAffected()})
+	}
+	endSpan(span, err)
 
 	return result, err
 }
 
-// Query выполняет SQL запрос с повторными попытками
+// Query выполняет SQL запрос с повторными попытками.
+// Если включен Config.BufferReplicaQueries, строки читаются внутри повторных попыток
 func (rc *retryableConn) Query(ctx context.Context, sql string, args ...any) (Rows, error) {
 	var result Rows
 	var err error
 
+	ctx, span := rc.manager.db.startSpan(ctx, spanQuery, sql)
 	err = rc.manager.ExecuteQueryWithRetry(ctx, func(conn Conn) error {
 		result, err = conn.Query(ctx, sql, args...)
+		if err == nil && rc.manager.db.config.BufferReplicaQueries {
+			result, err = rc.manager.db.bufferRows(result)
+		}
 		return err
 	})
+	endSpan(span, err)
 
 	return result, err
 }
@@ -56,10 +69,26 @@ func (rc *retryableConn) Begin(ctx context.Context) (Tx, error) {
 	return rc.conn.Begin(ctx)
 }
 
-// BeginTx начинает транзакцию с опциями
+// BeginTx начинает транзакцию с опциями. Транзакция только для чтения (AccessMode: pgx.ReadOnly)
+// открывается на узле, выбранном с повторными попытками и переключением между репликами,
+// и выполняется на нем до завершения. Остальные транзакции на репликах не поддерживаются
 func (rc *retryableConn) BeginTx(ctx context.Context, txOptions TxOptions) (Tx, error) {
-	// Для транзакций используем только мастер, иначе возвращаем ошибку
-	return rc.conn.BeginTx(ctx, txOptions)
+	if txOptions.AccessMode != pgx.ReadOnly {
+		// Для транзакций используем только мастер, иначе возвращаем ошибку
+		return rc.conn.BeginTx(ctx, txOptions)
+	}
+
+	var result Tx
+	var err error
+
+	ctx, span := rc.manager.db.startSpan(ctx, spanBegin, "")
+	err = rc.manager.ExecuteQueryWithRetry(ctx, func(conn Conn) error {
+		result, err = conn.BeginTx(ctx, txOptions)
+		return err
+	})
+	endSpan(span, err)
+
+	return result, err
 }
 
 // Ping проверяет соединение
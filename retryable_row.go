@@ -22,12 +22,14 @@ func (rr *retryableRow) Scan(dest ...any) error {
 	}
 
 	// Если row еще не установлен, выполняем запрос с повторными попытками
-	err := rr.manager.ExecuteQueryWithRetry(rr.ctx, func(conn Conn) error {
-		row := conn.QueryRow(rr.ctx, rr.sql, rr.args...)
+	ctx, span := rr.manager.db.startSpan(rr.ctx, spanQueryRow, rr.sql)
+	err := rr.manager.ExecuteQueryWithRetry(ctx, func(conn Conn) error {
+		row := conn.QueryRow(ctx, rr.sql, rr.args...)
 		rr.row = row
 		rr.err = row.Scan(dest...)
 		return rr.err
 	})
+	endSpan(span, err)
 
 	return err
 }
@@ -0,0 +1,42 @@
+package pgxwrapper
+
+import (
+	"context"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// CollectRows читает все строки rows, преобразует каждую функцией fn и закрывает rows.
+// В качестве fn подходят функции pgx: pgx.RowToStructByName, pgx.RowTo, pgx.RowToMap и другие
+func CollectRows[T any](rows Rows, fn pgx.RowToFunc[T]) ([]T, error) {
+	return pgx.CollectRows[T](rows, fn)
+}
+
+// CollectOneRow преобразует первую строку rows функцией fn и закрывает rows.
+// Если строк нет, возвращает pgx.ErrNoRows
+func CollectOneRow[T any](rows Rows, fn pgx.RowToFunc[T]) (T, error) {
+	return pgx.CollectOneRow[T](rows, fn)
+}
+
+// QueryAll выполняет запрос на conn и возвращает все строки в виде структур T.
+// Столбцы сопоставляются полям по тегу db или по имени поля без учета регистра
+// (pgx.RowToStructByName). conn может быть любым подключением драйвера, в том числе
+// DB.Slave() с повторными попытками и переключением между репликами
+func QueryAll[T any](ctx context.Context, conn Conn, sql string, args ...any) ([]T, error) {
+	rows, err := conn.Query(ctx, sql, args...)
+	if err != nil {
+		return nil, err
+	}
+	return CollectRows(rows, pgx.RowToStructByName[T])
+}
+
+// QueryOne выполняет запрос на conn и возвращает первую строку в виде структуры T.
+// Если строк нет, возвращает pgx.ErrNoRows
+func QueryOne[T any](ctx context.Context, conn Conn, sql string, args ...any) (T, error) {
+	rows, err := conn.Query(ctx, sql, args...)
+	if err != nil {
+		var zero T
+		return zero, err
+	}
+	return CollectOneRow(rows, pgx.RowToStructByName[T])
+}
@@ -0,0 +1,126 @@
+package pgxwrapper
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"math/rand/v2"
+	"strconv"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// slowQueryExplainTimeout максимальное время получения плана медленного запроса,
+// если Config.QueryTimeout не задан
+const slowQueryExplainTimeout = 5 * time.Second
+
+// errExplainPoolBusy план не запрашивается, так как в пуле узла нет свободных подключений
+var errExplainPoolBusy = errors.New("no idle connection to explain slow query")
+
+// isSlow проверяет, превышает ли длительность операции Config.SlowQueryThreshold
+func (db *DB) isSlow(duration time.Duration) bool {
+	return db.config.SlowQueryThreshold > 0 && duration >= db.config.SlowQueryThreshold
+}
+
+// sampleExplain решает, нужно ли получить план для очередного медленного запроса
+func (db *DB) sampleExplain() bool {
+	rate := db.config.SlowQueryExplainRate
+	return rate >= 1 || (rate > 0 && rand.Float64() < rate)
+}
+
+// logSlowQuery записывает медленную операцию в лог. Если операция выполнялась на пуле узла
+// и выбрана для получения плана, план EXPLAIN (FORMAT JSON) запрашивается в фоне на том же
+// узле и добавляется к записи. Одновременно запрашивается не более одного плана: если план
+// другого запроса еще не получен, запись выполняется без плана
+func (db *DB) logSlowQuery(ctx context.Context, op *trackedOperation) {
+	attrs := []any{
+		"operation", string(op.Kind),
+		"role", op.Role,
+		"node", op.Node,
+		"duration", op.Duration,
+	}
+	if op.SQL != "" {
+		attrs = append(attrs, "sql", op.SQL, "fingerprint", FingerprintSQL(op.SQL))
+	}
+	if fingerprint := argsFingerprint(op.Args); fingerprint != "" {
+		attrs = append(attrs, "args_fingerprint", fingerprint)
+	}
+	if op.Err != nil {
+		attrs = append(attrs, "error", op.Err)
+	}
+
+	if op.pool == nil || !explainable(op.Kind) || !singleStatement(op.SQL) || !db.sampleExplain() ||
+		!db.explainRunning.CompareAndSwap(false, true) {
+		db.logger.WarnContext(ctx, "Медленный запрос", attrs...)
+		return
+	}
+
+	// Аргументы копируются, так как вызывающий код может изменить срез после возврата
+	args := append([]any(nil), op.Args...)
+	pool, sql := op.pool, op.SQL
+	backgroundCtx := db.backgroundCtx
+	if backgroundCtx == nil {
+		backgroundCtx = context.Background()
+	}
+	started := db.runBackground(backgroundCtx, func(bgCtx context.Context) {
+		defer db.explainRunning.Store(false)
+
+		plan, err := db.explain(bgCtx, pool, sql, args)
+		if err != nil {
+			attrs = append(attrs, "explain_error", err)
+		} else {
+			attrs = append(attrs, "plan", plan)
+		}
+		db.logger.WarnContext(ctx, "Медленный запрос", attrs...)
+	})
+	if !started {
+		// Драйвер закрывается: запись выполняется без плана
+		db.explainRunning.Store(false)
+		db.logger.WarnContext(ctx, "Медленный запрос", attrs...)
+	}
+}
+
+// explainable проверяет, можно ли получить план операции: пакет запросов
+// нельзя передать в EXPLAIN одной командой
+func explainable(kind OperationKind) bool {
+	return kind == OperationExec || kind == OperationQuery || kind == OperationQueryRow
+}
+
+// explain возвращает план запроса sql в формате JSON. Запрос не выполняется.
+// План запрашивается только при наличии свободного подключения в пуле, чтобы не занимать
+// подключения, которых ждут запросы приложения
+func (db *DB) explain(ctx context.Context, pool *pgxpool.Pool, sql string, args []any) (json.RawMessage, error) {
+	if pool.Stat().IdleConns() == 0 {
+		return nil, errExplainPoolBusy
+	}
+
+	timeout := db.config.QueryTimeout
+	if timeout <= 0 {
+		timeout = slowQueryExplainTimeout
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	var plan []byte
+	if err := pool.QueryRow(ctx, "EXPLAIN (FORMAT JSON) "+sql, args...).Scan(&plan); err != nil {
+		return nil, fmt.Errorf("error explaining slow query: %w", err)
+	}
+	return json.RawMessage(plan), nil
+}
+
+// argsFingerprint возвращает хеш типов и значений аргументов запроса. Позволяет сопоставлять
+// медленные запросы с одинаковыми аргументами, не записывая значения в лог
+func argsFingerprint(args []any) string {
+	if len(args) == 0 {
+		return ""
+	}
+
+	h := fnv.New64a()
+	for _, arg := range args {
+		fmt.Fprintf(h, "%T:%v\x00", arg, arg)
+	}
+	return strconv.FormatUint(h.Sum64(), 16)
+}
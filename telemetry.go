@@ -19,6 +19,23 @@ type Telemetry struct {
 	totalRetries     int64
 	queryDuration    time.Duration
 	connectionErrors int64
+
+	// Метрики COPY
+	copyFromRows  int64
+	copyFromBytes int64
+	copyToRows    int64
+	copyToBytes   int64
+
+	// operations метрики операций по ролям узлов и видам операций
+	operations map[operationKey]*operationMetrics
+
+	// queries статистика запросов по отпечаткам
+	queries map[string]*queryStats
+
+	// fingerprintMu защищает fingerprints - кеш отпечатков по тексту запроса.
+	// Отдельная блокировка позволяет вычислять отпечатки, не задерживая учет операций
+	fingerprintMu sync.RWMutex
+	fingerprints  map[string]string
 }
 
 // NewTelemetry создает новый экземпляр телеметрии
@@ -107,6 +124,32 @@ func (t *Telemetry) RecordConnectionError() {
 	t.connectionErrors++
 }
 
+// RecordCopyFrom записывает количество строк и байт, загруженных командой COPY FROM
+func (t *Telemetry) RecordCopyFrom(rows, bytes int64) {
+	if !t.IsEnabled() {
+		return
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.copyFromRows += rows
+	t.copyFromBytes += bytes
+}
+
+// RecordCopyTo записывает количество строк и байт, выгруженных командой COPY TO
+func (t *Telemetry) RecordCopyTo(rows, bytes int64) {
+	if !t.IsEnabled() {
+		return
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.copyToRows += rows
+	t.copyToBytes += bytes
+}
+
 // GetMetrics возвращает текущие метрики
 func (t *Telemetry) GetMetrics() map[string]any {
 	t.mu.RLock()
@@ -123,6 +166,10 @@ func (t *Telemetry) GetMetrics() map[string]any {
 		"total_retries":     t.totalRetries,
 		"average_duration":  avgDuration,
 		"connection_errors": t.connectionErrors,
+		"copy_from_rows":    t.copyFromRows,
+		"copy_from_bytes":   t.copyFromBytes,
+		"copy_to_rows":      t.copyToRows,
+		"copy_to_bytes":     t.copyToBytes,
 		"enabled":           t.enabled,
 	}
 }
@@ -0,0 +1,324 @@
+package pgxwrapper
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// defaultTopologyCheckInterval интервал проверки ролей узлов по умолчанию
+const defaultTopologyCheckInterval = 10 * time.Second
+
+// hostRoleQuery запрос, определяющий роль узла и имя, под которым реплика
+// подключается к мастеру (application_name из primary_conninfo, cluster_name или значение по умолчанию)
+const hostRoleQuery = `SELECT
+	pg_is_in_recovery(),
+	coalesce(
+		(SELECT substring(conninfo from 'application_name=([^ ]+)') FROM pg_stat_wal_receiver),
+		nullif(current_setting('cluster_name'), ''),
+		'walreceiver'
+	)`
+
+// syncStandbysQuery запрос к мастеру, возвращающий имена синхронных реплик
+const syncStandbysQuery = `SELECT application_name FROM pg_stat_replication WHERE sync_state IN ('sync', 'quorum')`
+
+// topology распределение узлов кластера по ролям
+type topology struct {
+	master      *node
+	syncSlave   *node
+	asyncSlaves []*node
+}
+
+// replicas возвращает все реплики
+func (t topology) replicas() []*node {
+	nodes := make([]*node, 0, len(t.asyncSlaves)+1)
+	if t.syncSlave != nil {
+		nodes = append(nodes, t.syncSlave)
+	}
+	return append(nodes, t.asyncSlaves...)
+}
+
+// nodes возвращает все узлы: мастер и реплики
+func (t topology) nodes() []*node {
+	nodes := make([]*node, 0, len(t.asyncSlaves)+2)
+	if t.master != nil {
+		nodes = append(nodes, t.master)
+	}
+	return append(nodes, t.replicas()...)
+}
+
+// currentTopology возвращает текущее распределение узлов по ролям
+func (db *DB) currentTopology() topology {
+	db.topologyMu.RLock()
+	defer db.topologyMu.RUnlock()
+	return topology{master: db.master, syncSlave: db.syncSlave, asyncSlaves: db.asyncSlaves}
+}
+
+// setTopology заменяет распределение узлов по ролям
+func (db *DB) setTopology(t topology) {
+	db.topologyMu.Lock()
+	defer db.topologyMu.Unlock()
+	db.master, db.syncSlave, db.asyncSlaves = t.master, t.syncSlave, t.asyncSlaves
+}
+
+// clusterHost узел из Config.Hosts с собственным пулом подключений
+type clusterHost struct {
+	// addr адрес узла в формате host:port
+	addr string
+
+	// pool пул подключений к узлу
+	pool *pgxpool.Pool
+
+	// index индекс узла в Config.Hosts
+	index int
+}
+
+// newClusterHosts создает пулы подключений ко всем узлам из Config.Hosts.
+// Параметры подключения берутся из MasterConnString, адрес заменяется адресом узла.
+// Пулы подключаются лениво, поэтому недоступный узел не мешает созданию драйвера
+func newClusterHosts(ctx context.Context, config Config) ([]*clusterHost, error) {
+	var hosts []*clusterHost
+	for i, addr := range config.Hosts {
+		poolConfig, err := newPoolConfig(config.MasterConnString, config.MasterPool)
+		if err != nil {
+			return nil, err
+		}
+
+		host, port, err := splitHostPort(addr, poolConfig.ConnConfig.Port)
+		if err != nil {
+			return nil, fmt.Errorf("%w: invalid host %q: %v", ErrInvalidConfiguration, addr, err)
+		}
+		poolConfig.ConnConfig.Host = host
+		poolConfig.ConnConfig.Port = port
+		poolConfig.ConnConfig.Fallbacks = nil
+
+		pool, err := pgxpool.NewWithConfig(ctx, poolConfig)
+		if err != nil {
+			closeClusterHosts(hosts)
+			return nil, err
+		}
+		hosts = append(hosts, &clusterHost{addr: net.JoinHostPort(host, strconv.Itoa(int(port))), pool: pool, index: i})
+	}
+	return hosts, nil
+}
+
+// splitHostPort разбирает адрес узла; если порт не указан, используется defaultPort
+func splitHostPort(addr string, defaultPort uint16) (string, uint16, error) {
+	host, portText, err := net.SplitHostPort(addr)
+	if err != nil {
+		// Адрес без порта
+		return addr, defaultPort, nil
+	}
+
+	port, err := strconv.ParseUint(portText, 10, 16)
+	if err != nil {
+		return "", 0, err
+	}
+	return host, uint16(port), nil
+}
+
+// closeClusterHosts закрывает пулы подключений ко всем узлам
+func closeClusterHosts(hosts []*clusterHost) {
+	for _, h := range hosts {
+		h.pool.Close()
+	}
+}
+
+// hostRole роль узла, определенная при опросе
+type hostRole struct {
+	host            *clusterHost
+	inRecovery      bool
+	applicationName string
+}
+
+// refreshTopology опрашивает узлы из Config.Hosts, определяет мастер по pg_is_in_recovery()
+// и синхронные реплики по pg_stat_replication, после чего перераспределяет роли.
+// Если мастер не найден, текущее распределение не меняется
+func (db *DB) refreshTopology(ctx context.Context) error {
+	db.discoveryMu.Lock()
+	defer db.discoveryMu.Unlock()
+	return db.refreshTopologyLocked(ctx)
+}
+
+// refreshTopologyLocked выполняет refreshTopology; вызывающий должен удерживать discoveryMu
+func (db *DB) refreshTopologyLocked(ctx context.Context) error {
+	var (
+		master *hostRole
+		roles  []hostRole
+	)
+	for _, h := range db.hosts {
+		role, err := db.probeHost(ctx, h)
+		if err != nil {
+			db.logger.WarnContext(ctx, "Не удалось определить роль узла", "host", h.addr, "error", err)
+			continue
+		}
+		if !role.inRecovery {
+			if master != nil {
+				db.logger.WarnContext(ctx, "Обнаружено несколько мастеров", "master", master.host.addr, "host", h.addr)
+				continue
+			}
+			master = &role
+			continue
+		}
+		roles = append(roles, role)
+	}
+
+	if master == nil {
+		return ErrMasterNotFound
+	}
+
+	syncNames, err := db.syncStandbyNames(ctx, master.host)
+	if err != nil {
+		db.logger.WarnContext(ctx, "Не удалось получить список синхронных реплик", "host", master.host.addr, "error", err)
+	}
+
+	// Имена реплик, которые подключаются к мастеру под одинаковым именем, нельзя сопоставить однозначно
+	nameCount := make(map[string]int)
+	for _, role := range roles {
+		nameCount[role.applicationName]++
+	}
+
+	current := db.currentTopology()
+	next := topology{master: db.hostNode(current, master.host, true, AsyncReplica)}
+	for _, role := range roles {
+		if next.syncSlave == nil && syncNames[role.applicationName] && nameCount[role.applicationName] == 1 {
+			next.syncSlave = db.hostNode(current, role.host, false, SyncReplica)
+			continue
+		}
+		next.asyncSlaves = append(next.asyncSlaves, db.hostNode(current, role.host, false, AsyncReplica))
+	}
+
+	if current.master != nil && current.master.pool != next.master.pool {
+		db.logger.WarnContext(ctx, "Мастер изменился", "previous", current.master.name, "current", next.master.name)
+	}
+	db.setTopology(next)
+	return nil
+}
+
+// probeHost определяет роль узла
+func (db *DB) probeHost(ctx context.Context, h *clusterHost) (hostRole, error) {
+	ctx, cancel := context.WithTimeout(ctx, db.topologyCheckInterval())
+	defer cancel()
+
+	role := hostRole{host: h}
+	err := h.pool.QueryRow(ctx, hostRoleQuery).Scan(&role.inRecovery, &role.applicationName)
+	return role, err
+}
+
+// syncStandbyNames возвращает имена синхронных реплик мастера
+func (db *DB) syncStandbyNames(ctx context.Context, master *clusterHost) (map[string]bool, error) {
+	ctx, cancel := context.WithTimeout(ctx, db.topologyCheckInterval())
+	defer cancel()
+
+	rows, err := master.pool.Query(ctx, syncStandbysQuery)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	names := make(map[string]bool)
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return nil, err
+		}
+		names[name] = true
+	}
+	return names, rows.Err()
+}
+
+// hostNode возвращает узел для хоста с указанной ролью.
+// Если роль хоста не изменилась, используется существующий узел, чтобы сохранить его состояние
+func (db *DB) hostNode(current topology, h *clusterHost, isMaster bool, replicaType ReplicaType) *node {
+	for _, n := range current.nodes() {
+		if n.pool == h.pool && n.isMaster == isMaster && (isMaster || n.replicaType == replicaType) {
+			return n
+		}
+	}
+
+	n := &node{pool: h.pool, isMaster: isMaster, replicaType: replicaType, index: h.index}
+	switch {
+	case isMaster:
+		n.name = fmt.Sprintf("master (%s)", h.addr)
+	case replicaType == SyncReplica:
+		n.name = fmt.Sprintf("sync slave (%s)", h.addr)
+	default:
+		n.name = fmt.Sprintf("async slave (%s)", h.addr)
+	}
+	return n
+}
+
+// topologyCheckInterval возвращает интервал проверки ролей узлов
+func (db *DB) topologyCheckInterval() time.Duration {
+	if db.config.TopologyCheckInterval > 0 {
+		return db.config.TopologyCheckInterval
+	}
+	return defaultTopologyCheckInterval
+}
+
+// watchTopology периодически и по запросу перепроверяет роли узлов до отмены контекста
+func (db *DB) watchTopology(ctx context.Context) {
+	ticker := time.NewTicker(db.topologyCheckInterval())
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		case <-db.topologyRefresh:
+		}
+
+		if err := db.refreshTopology(ctx); err != nil && ctx.Err() == nil {
+			db.logger.WarnContext(ctx, "Не удалось обновить роли узлов", "error", err)
+		}
+	}
+}
+
+// requestTopologyRefresh запрашивает внеочередную проверку ролей узлов, не дожидаясь ее
+func (db *DB) requestTopologyRefresh() {
+	if db.topologyRefresh == nil {
+		return
+	}
+	select {
+	case db.topologyRefresh <- struct{}{}:
+	default:
+		// Проверка уже запрошена
+	}
+}
+
+// failoverMaster перепроверяет роли узлов после ошибки записи на бывший мастер
+// и возвращает новый мастер, если он изменился
+func (db *DB) failoverMaster(ctx context.Context, stale *pgxpool.Pool) (*node, bool) {
+	if len(db.hosts) == 0 {
+		return nil, false
+	}
+
+	db.discoveryMu.Lock()
+	defer db.discoveryMu.Unlock()
+
+	// Роли могли быть уже перераспределены параллельным запросом
+	if master := db.currentTopology().master; master.pool != stale {
+		return master, true
+	}
+
+	if err := db.refreshTopologyLocked(ctx); err != nil {
+		db.logger.WarnContext(ctx, "Не удалось найти новый мастер", "error", err)
+		return nil, false
+	}
+
+	master := db.currentTopology().master
+	return master, master.pool != stale
+}
+
+// isReadOnlyError проверяет, выполнялась ли запись на узле в режиме только для чтения
+func isReadOnlyError(err error) bool {
+	var pgErr *pgconn.PgError
+	return errors.As(err, &pgErr) && pgErr.Code == "25006" // SQLSTATE read_only_sql_transaction
+}
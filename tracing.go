@@ -0,0 +1,136 @@
+package pgxwrapper
+
+import (
+	"context"
+	"errors"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// Tracer создает спаны для операций драйвера. Интерфейс повторяет основу trace.Tracer
+// из OpenTelemetry, поэтому адаптер к нему занимает несколько строк, а драйвер не
+// зависит от конкретной библиотеки трассировки
+type Tracer interface {
+	// Start начинает спан name, дочерний по отношению к спану из ctx,
+	// и возвращает контекст с новым спаном
+	Start(ctx context.Context, name string) (context.Context, Span)
+}
+
+// Span спан операции драйвера
+type Span interface {
+	// SetAttributes добавляет атрибуты спана
+	SetAttributes(attrs ...Attribute)
+
+	// RecordError отмечает спан как завершившийся ошибкой
+	RecordError(err error)
+
+	// End завершает спан
+	End()
+}
+
+// Attribute атрибут спана
+type Attribute struct {
+	Key   string
+	Value any
+}
+
+// Ключи атрибутов спанов
+const (
+	// AttrDBSystem система управления базами данных, всегда "postgresql"
+	AttrDBSystem = "db.system"
+
+	// AttrDBStatement текст SQL запроса, см. Config.SanitizeTracedSQL
+	AttrDBStatement = "db.statement"
+
+	// AttrNodeRole роль узла: master, sync или async
+	AttrNodeRole = "db.node.role"
+
+	// AttrRowsAffected количество строк, измененных командой или переданных COPY
+	AttrRowsAffected = "db.rows_affected"
+
+	// AttrRetryAttempt номер попытки логического вызова, начиная с 1
+	AttrRetryAttempt = "db.retry.attempt"
+
+	// AttrFallbackHop номер узла в порядке переключения внутри попытки, начиная с 0
+	AttrFallbackHop = "db.fallback.hop"
+)
+
+// Имена спанов операций
+const (
+	spanExec     = "pgxwrapper.Exec"
+	spanQuery    = "pgxwrapper.Query"
+	spanQueryRow = "pgxwrapper.QueryRow"
+	spanBegin    = "pgxwrapper.Begin"
+	spanCommit   = "pgxwrapper.Commit"
+	spanRollback = "pgxwrapper.Rollback"
+	spanBatch    = "pgxwrapper.SendBatch"
+	spanCopyFrom = "pgxwrapper.CopyFrom"
+	spanCopyTo   = "pgxwrapper.CopyTo"
+)
+
+// operationSpans имена спанов для видов операций
+var operationSpans = map[OperationKind]string{
+	OperationExec:     spanExec,
+	OperationQuery:    spanQuery,
+	OperationQueryRow: spanQueryRow,
+	OperationBegin:    spanBegin,
+	OperationCommit:   spanCommit,
+	OperationRollback: spanRollback,
+	OperationBatch:    spanBatch,
+	OperationCopyFrom: spanCopyFrom,
+	OperationCopyTo:   spanCopyTo,
+}
+
+// noopSpan спан, который ничего не записывает. Используется, если Config.Tracer не задан
+type noopSpan struct{}
+
+func (noopSpan) SetAttributes(...Attribute) {}
+func (noopSpan) RecordError(error)          {}
+func (noopSpan) End()                       {}
+
+// fallbackPosition положение операции в повторных попытках и переключении между узлами.
+// Нулевое значение означает, что операция выполняется вне ReplicaManager
+type fallbackPosition struct {
+	// attempt номер попытки, начиная с 1
+	attempt int
+
+	// hop номер узла в порядке переключения внутри попытки, начиная с 0
+	hop int
+}
+
+// attributes возвращает атрибуты спана для положения операции
+func (p fallbackPosition) attributes() []Attribute {
+	if p.attempt == 0 {
+		return nil
+	}
+	return []Attribute{
+		{Key: AttrRetryAttempt, Value: p.attempt},
+		{Key: AttrFallbackHop, Value: p.hop},
+	}
+}
+
+// startSpan начинает спан name с SQL запросом sql, если задан Config.Tracer
+func (db *DB) startSpan(ctx context.Context, name, sql string) (context.Context, Span) {
+	if db.config.Tracer == nil {
+		return ctx, noopSpan{}
+	}
+
+	ctx, span := db.config.Tracer.Start(ctx, name)
+	attrs := []Attribute{{Key: AttrDBSystem, Value: "postgresql"}}
+	if sql != "" {
+		if db.config.SanitizeTracedSQL {
+			sql = sanitizeSQL(sql)
+		}
+		attrs = append(attrs, Attribute{Key: AttrDBStatement, Value: sql})
+	}
+	span.SetAttributes(attrs...)
+	return ctx, span
+}
+
+// endSpan завершает спан, отмечая ошибку. Отсутствие строк ошибкой не считается
+func endSpan(span Span, err error) {
+	if err != nil && !errors.Is(err, pgx.ErrNoRows) {
+		span.RecordError(err)
+	}
+	span.End()
+}
@@ -2,22 +2,32 @@ package pgxwrapper
 
 import (
 	"context"
+	"errors"
 	"fmt"
-	"time"
+
+	"github.com/jackc/pgx/v5"
 )
 
-// BeginTx начинает новую транзакцию на мастере
+// BeginTx начинает новую транзакцию на мастере. Если в контексте есть внешняя
+// транзакция (WithTx), создается вложенная транзакция на ее точке сохранения
 func (db *DB) BeginTx(ctx context.Context, txOptions TxOptions) (Tx, error) {
-	if db.telemetry != nil && db.telemetry.IsEnabled() {
-		start := time.Now()
-		defer func() {
-			duration := time.Since(start)
-			db.telemetry.RecordQuery(duration)
-		}()
+	if outer, ok := TxFromContext(ctx); ok {
+		return outer.BeginTx(ctx, txOptions)
 	}
 
 	// Все транзакции начинаются только на мастере
-	tx, err := db.master.BeginTx(ctx, txOptions.TxOptions)
+	master := db.currentTopology().master.name
+	ctx, op, err := db.startOperation(ctx, Operation{Kind: OperationBegin, Role: roleMaster, Node: master}, fallbackPosition{})
+	if err != nil {
+		return nil, err
+	}
+
+	var tx pgx.Tx
+	err = db.withReconnect(ctx, func() (err error) {
+		tx, err = db.currentTopology().master.pool.BeginTx(ctx, txOptions.TxOptions)
+		return err
+	})
+	op.end(err)
 	if err != nil {
 		if db.telemetry != nil {
 			db.telemetry.RecordError()
@@ -26,23 +36,35 @@ func (db *DB) BeginTx(ctx context.Context, txOptions TxOptions) (Tx, error) {
 	}
 
 	return &txWrapper{
-		tx: tx,
-		db: db,
+		tx:       tx,
+		db:       db,
+		role:     roleMaster,
+		node:     master,
+		readOnly: txOptions.AccessMode == pgx.ReadOnly,
+		options:  txOptions.TxOptions,
 	}, nil
 }
 
-// Begin начинает новую транзакцию на мастере с параметрами по умолчанию
+// Begin начинает новую транзакцию на мастере с параметрами по умолчанию. Если в контексте
+// есть внешняя транзакция (WithTx), создается вложенная транзакция на ее точке сохранения
 func (db *DB) Begin(ctx context.Context) (Tx, error) {
-	if db.telemetry != nil && db.telemetry.IsEnabled() {
-		start := time.Now()
-		defer func() {
-			duration := time.Since(start)
-			db.telemetry.RecordQuery(duration)
-		}()
+	if outer, ok := TxFromContext(ctx); ok {
+		return outer.Begin(ctx)
 	}
 
 	// Все транзакции начинаются только на мастере
-	tx, err := db.master.Begin(ctx)
+	master := db.currentTopology().master.name
+	ctx, op, err := db.startOperation(ctx, Operation{Kind: OperationBegin, Role: roleMaster, Node: master}, fallbackPosition{})
+	if err != nil {
+		return nil, err
+	}
+
+	var tx pgx.Tx
+	err = db.withReconnect(ctx, func() (err error) {
+		tx, err = db.currentTopology().master.pool.Begin(ctx)
+		return err
+	})
+	op.end(err)
 	if err != nil {
 		if db.telemetry != nil {
 			db.telemetry.RecordError()
@@ -51,49 +73,65 @@ func (db *DB) Begin(ctx context.Context) (Tx, error) {
 	}
 
 	return &txWrapper{
-		tx: tx,
-		db: db,
+		tx:   tx,
+		db:   db,
+		role: roleMaster,
+		node: master,
 	}, nil
 }
 
-// ExecuteInTransaction выполняет функцию в транзакции с автоматическим коммитом или откатом
+// txContextKey ключ контекста для внешней транзакции
+type txContextKey struct{}
+
+// WithTx возвращает контекст, хранящий транзакцию tx. Операции DB.Master(), DB.Begin,
+// DB.BeginTx и ExecuteInTransaction с таким контекстом выполняются внутри tx
+func WithTx(ctx context.Context, tx Tx) context.Context {
+	return context.WithValue(ctx, txContextKey{}, tx)
+}
+
+// TxFromContext возвращает транзакцию, сохраненную в контексте функцией WithTx
+func TxFromContext(ctx context.Context) (Tx, bool) {
+	tx, ok := ctx.Value(txContextKey{}).(Tx)
+	return tx, ok
+}
+
+// ExecuteInTransaction выполняет функцию в транзакции с автоматическим коммитом или откатом.
+// Если в контексте есть внешняя транзакция (WithTx), функция выполняется во вложенной
+// транзакции на точке сохранения внешней, а параметры txOptions должны совпадать
+// с параметрами внешней транзакции (см. ErrTxOptionsConflict)
 func (db *DB) ExecuteInTransaction(ctx context.Context, txOptions TxOptions, fn func(Tx) error) error {
 	tx, err := db.BeginTx(ctx, txOptions)
 	if err != nil {
 		return fmt.Errorf("transaction begin error: %w", err)
 	}
-	defer func() {
-		if tx != nil {
-			// Если транзакция не завершена (не зафиксирована и не откачена), откатываем
-			tx.Rollback(ctx)
-		}
-	}()
-
-	err = fn(tx)
-	if err != nil {
-		rbErr := tx.Rollback(ctx)
-		if rbErr != nil {
-			return fmt.Errorf("function execution error in transaction: %v, rollback error: %w", err, rbErr)
-		}
-		return err
-	}
-
-	err = tx.Commit(ctx)
-	if err != nil {
-		return fmt.Errorf("transaction commit error: %w", err)
-	}
 
-	// Устанавливаем tx в nil, чтобы избежать двойного отката в defer
-	tx = nil
-	return nil
+	return runInTransaction(ctx, tx, fn)
 }
 
-// ExecuteInTransactionDefault выполняет функцию в транзакции с параметрами по умолчанию
+// ExecuteInTransactionDefault выполняет функцию в транзакции с параметрами по умолчанию.
+// Если в контексте есть внешняя транзакция (WithTx), функция выполняется во вложенной
+// транзакции на точке сохранения внешней
 func (db *DB) ExecuteInTransactionDefault(ctx context.Context, fn func(Tx) error) error {
 	tx, err := db.Begin(ctx)
 	if err != nil {
 		return fmt.Errorf("transaction begin error: %w", err)
 	}
+
+	return runInTransaction(ctx, tx, fn)
+}
+
+// WithinTransaction выполняет функцию в транзакции так же, как ExecuteInTransaction,
+// но передает ей контекст с активной транзакцией вместо самой транзакции.
+// Код, работающий с DB.Master() и этим контекстом, выполняется внутри транзакции
+// без явной передачи Tx
+func (db *DB) WithinTransaction(ctx context.Context, txOptions TxOptions, fn func(ctx context.Context) error) error {
+	return db.ExecuteInTransaction(ctx, txOptions, func(tx Tx) error {
+		return fn(WithTx(ctx, tx))
+	})
+}
+
+// runInTransaction выполняет функцию в начатой транзакции и фиксирует ее или откатывает при ошибке
+func runInTransaction(ctx context.Context, tx Tx, fn func(Tx) error) error {
 	defer func() {
 		if tx != nil {
 			// Если транзакция не завершена (не зафиксирована и не откачена), откатываем
@@ -101,11 +139,12 @@ func (db *DB) ExecuteInTransactionDefault(ctx context.Context, fn func(Tx) error
 		}
 	}()
 
-	err = fn(tx)
+	err := fn(tx)
 	if err != nil {
 		rbErr := tx.Rollback(ctx)
 		if rbErr != nil {
-			return fmt.Errorf("function execution error in transaction: %v, rollback error: %w", err, rbErr)
+			// Обе ошибки оборачиваются, чтобы конфликт сериализации из fn оставался виден классификатору
+			return fmt.Errorf("function execution error in transaction: %w, rollback error: %w", err, rbErr)
 		}
 		return err
 	}
@@ -119,3 +158,49 @@ func (db *DB) ExecuteInTransactionDefault(ctx context.Context, fn func(Tx) error
 	tx = nil
 	return nil
 }
+
+// ExecuteInTransactionWithRetry выполняет функцию в транзакции и, если транзакция завершилась
+// ошибкой сериализации или взаимоблокировкой (40001, 40P01), повторяет ее целиком.
+// Количество повторов ограничено Config.MaxRetries, задержка определяется Config.RetryPolicy,
+// ожидание прерывается при отмене контекста. fn может быть вызвана несколько раз.
+// Внутри внешней транзакции (WithTx) повтор не выполняется: конфликт сериализации
+// должна обработать внешняя транзакция
+func (db *DB) ExecuteInTransactionWithRetry(ctx context.Context, txOptions TxOptions, fn func(Tx) error) error {
+	if _, ok := TxFromContext(ctx); ok {
+		return db.ExecuteInTransaction(ctx, txOptions, fn)
+	}
+
+	return db.retrySerializationFailures(ctx, func() error {
+		return db.ExecuteInTransaction(ctx, txOptions, fn)
+	})
+}
+
+// retrySerializationFailures выполняет транзакцию run и повторяет ее при конфликтах
+// сериализации и взаимоблокировках по правилам ExecuteInTransactionWithRetry
+func (db *DB) retrySerializationFailures(ctx context.Context, run func() error) error {
+	b := db.newBackoff()
+
+	for attempt := 1; ; attempt++ {
+		err := run()
+		if err == nil || db.classifyError(err) != ErrorClassSerialization {
+			return err
+		}
+
+		if attempt > db.config.MaxRetries {
+			return fmt.Errorf("transaction not committed after %d attempts: %w", attempt, err)
+		}
+
+		// Увеличиваем счетчик повторных попыток в телеметрии
+		if db.telemetry != nil {
+			db.telemetry.RecordRetry()
+		}
+		db.logger.InfoContext(ctx, "Конфликт сериализации, транзакция будет повторена", "attempt", attempt, "error", err)
+
+		if waitErr := b.wait(ctx); waitErr != nil {
+			if errors.Is(waitErr, errRetryBudgetExhausted) {
+				return fmt.Errorf("transaction not committed after %d attempts: %w", attempt, err)
+			}
+			return fmt.Errorf("transaction retry interrupted after %d attempts: %w: %w", attempt, waitErr, err)
+		}
+	}
+}
@@ -4,7 +4,6 @@ import (
 	"context"
 	"errors"
 	"fmt"
-	"time"
 
 	"github.com/jackc/pgx/v5"
 	"github.com/jackc/pgx/v5/pgconn"
@@ -13,11 +12,30 @@ import (
 // rowsWrapper обертка для Rows
 type rowsWrapper struct {
 	rows pgx.Rows
+
+	// cancel отменяет таймаут запроса при закрытии Rows
+	cancel context.CancelFunc
+
+	// done завершает операцию запроса результатом и ошибкой чтения строк. Вызывается один раз,
+	// когда строки прочитаны полностью или Rows закрыт
+	done func(tag pgconn.CommandTag, err error)
 }
 
 // Close закрывает Rows
 func (r *rowsWrapper) Close() {
 	r.rows.Close()
+	r.finish()
+	if r.cancel != nil {
+		r.cancel()
+	}
+}
+
+// finish завершает операцию запроса после закрытия строк pgx
+func (r *rowsWrapper) finish() {
+	if r.done != nil {
+		r.done(r.rows.CommandTag(), r.rows.Err())
+		r.done = nil
+	}
 }
 
 // Err возвращает ошибку
@@ -27,7 +45,13 @@ func (r *rowsWrapper) Err() error {
 
 // Next проверяет, есть ли следующая строка
 func (r *rowsWrapper) Next() bool {
-	return r.rows.Next()
+	if r.rows.Next() {
+		return true
+	}
+	// pgx закрывает Rows после последней строки, поэтому операция завершается здесь,
+	// не дожидаясь Close
+	r.finish()
+	return false
 }
 
 // Scan сканирует значения в переменные
@@ -50,37 +74,95 @@ func (r *rowsWrapper) ColumnTypes() []any {
 	return result
 }
 
+// FieldDescriptions возвращает описания столбцов
+func (r *rowsWrapper) FieldDescriptions() []pgconn.FieldDescription {
+	return r.rows.FieldDescriptions()
+}
+
+// CommandTag возвращает результат выполнения команды. Доступен после чтения всех строк
+func (r *rowsWrapper) CommandTag() pgconn.CommandTag {
+	return r.rows.CommandTag()
+}
+
+// RawValues возвращает необработанные значения текущей строки.
+// Срезы действительны только до следующего вызова Next
+func (r *rowsWrapper) RawValues() [][]byte {
+	return r.rows.RawValues()
+}
+
+// Conn возвращает подключение, на котором выполняется запрос
+func (r *rowsWrapper) Conn() *pgx.Conn {
+	return r.rows.Conn()
+}
+
 // rowWrapper обертка для Row
 type rowWrapper struct {
 	row pgx.Row
+
+	// cancel отменяет таймаут запроса после сканирования
+	cancel context.CancelFunc
+
+	// done завершает учет операции в телеметрии: запрос выполняется при сканировании
+	done func(err error)
 }
 
 // Scan сканирует значения в переменные
 func (r *rowWrapper) Scan(dest ...any) error {
-	return r.row.Scan(dest...)
+	if r.cancel != nil {
+		defer r.cancel()
+	}
+	err := r.row.Scan(dest...)
+	if r.done != nil {
+		r.done(err)
+	}
+	return err
 }
 
 // txWrapper обертка для транзакции
 type txWrapper struct {
 	tx pgx.Tx
 	db *DB
+
+	// role роль узла, на котором открыта транзакция, в метках метрик
+	role string
+
+	// node имя узла, на котором открыта транзакция, для перехватчиков
+	node string
+
+	// nested признак вложенной транзакции на точке сохранения
+	nested bool
+
+	// readOnly признак транзакции только для чтения: она может быть открыта на реплике,
+	// поэтому ошибка записи в ней не означает смену мастера, а фиксация не создает LSN
+	readOnly bool
+
+	// options параметры, с которыми открыта внешняя транзакция. Вложенные транзакции
+	// наследуют их и не могут изменить
+	options pgx.TxOptions
+
+	// finished признак вызванного Commit или Rollback. Повторный Rollback, например
+	// отложенный после Commit, не считается операцией и не передается перехватчикам
+	finished bool
 }
 
 // Exec выполняет SQL команду в транзакции
 func (t *txWrapper) Exec(ctx context.Context, sql string, arguments ...any) (pgconn.CommandTag, error) {
-	if t.db.telemetry != nil && t.db.telemetry.IsEnabled() {
-		start := time.Now()
-		defer func() {
-			duration := time.Since(start)
-			t.db.telemetry.RecordQuery(duration)
-		}()
+	ctx, op, err := t.startOperation(ctx, OperationExec, sql, arguments)
+	if err != nil {
+		return pgconn.CommandTag{}, err
 	}
 
-	result, err := t.tx.Exec(ctx, sql, arguments...)
+	result, err := t.tx.Exec(ctx, op.SQL, op.Args...)
+	op.setResult(result)
+	op.end(err)
 	if err != nil {
 		if t.db.telemetry != nil {
 			t.db.telemetry.RecordError()
 		}
+		// Транзакция открыта на узле, который перестал быть мастером
+		if !t.readOnly && isReadOnlyError(err) {
+			t.db.requestTopologyRefresh()
+		}
 		return result, fmt.Errorf("error executing query in transaction: %w", err)
 	}
 
@@ -89,47 +171,90 @@ func (t *txWrapper) Exec(ctx context.Context, sql string, arguments ...any) (pgc
 
 // Query выполняет SQL запрос в транзакции
 func (t *txWrapper) Query(ctx context.Context, sql string, args ...any) (Rows, error) {
-	if t.db.telemetry != nil && t.db.telemetry.IsEnabled() {
-		start := time.Now()
-		defer func() {
-			duration := time.Since(start)
-			t.db.telemetry.RecordQuery(duration)
-		}()
+	ctx, op, err := t.startOperation(ctx, OperationQuery, sql, args)
+	if err != nil {
+		return nil, err
 	}
 
-	rows, err := t.tx.Query(ctx, sql, args...)
+	rows, err := t.tx.Query(ctx, op.SQL, op.Args...)
 	if err != nil {
+		op.end(err)
 		if t.db.telemetry != nil {
 			t.db.telemetry.RecordError()
 		}
 		return nil, fmt.Errorf("ошибка выполнения запроса в транзакции: %w", err)
 	}
 
-	return &rowsWrapper{rows: rows}, nil
+	return &rowsWrapper{rows: rows, done: op.endRows}, nil
 }
 
 // QueryRow выполняет SQL запрос и возвращает одну строку в транзакции
 func (t *txWrapper) QueryRow(ctx context.Context, sql string, args ...any) Row {
-	if t.db.telemetry != nil && t.db.telemetry.IsEnabled() {
-		start := time.Now()
-		defer func() {
-			duration := time.Since(start)
-			t.db.telemetry.RecordQuery(duration)
-		}()
+	ctx, op, err := t.startOperation(ctx, OperationQueryRow, sql, args)
+	if err != nil {
+		return errRow{err: err}
 	}
 
-	row := t.tx.QueryRow(ctx, sql, args...)
-	return &rowWrapper{row: row}
+	row := t.tx.QueryRow(ctx, op.SQL, op.Args...)
+	return &rowWrapper{row: row, done: op.end}
 }
 
-// Begin не поддерживается в транзакции
+// Begin начинает вложенную транзакцию, создавая точку сохранения (SAVEPOINT).
+// Commit вложенной транзакции освобождает точку сохранения, Rollback - откатывает к ней
 func (t *txWrapper) Begin(ctx context.Context) (Tx, error) {
-	return nil, errors.New("nested transactions are not supported")
+	ctx, op, err := t.startOperation(ctx, OperationBegin, "", nil)
+	if err != nil {
+		return nil, err
+	}
+
+	tx, err := t.tx.Begin(ctx)
+	op.end(err)
+	if err != nil {
+		if t.db.telemetry != nil {
+			t.db.telemetry.RecordError()
+		}
+		return nil, fmt.Errorf("error creating savepoint in transaction: %w", err)
+	}
+
+	return &txWrapper{
+		tx:       tx,
+		db:       t.db,
+		role:     t.role,
+		node:     t.node,
+		nested:   true,
+		readOnly: t.readOnly,
+		options:  t.options,
+	}, nil
 }
 
-// BeginTx не поддерживается в транзакции
+// BeginTx начинает вложенную транзакцию на точке сохранения. Точка сохранения наследует
+// параметры внешней транзакции, поэтому txOptions могут только повторять их: иначе
+// возвращается ErrTxOptionsConflict
 func (t *txWrapper) BeginTx(ctx context.Context, txOptions TxOptions) (Tx, error) {
-	return nil, errors.New("nested transactions are not supported")
+	if err := t.checkNestedOptions(txOptions.TxOptions); err != nil {
+		if t.db.telemetry != nil {
+			t.db.telemetry.RecordError()
+		}
+		return nil, err
+	}
+	return t.Begin(ctx)
+}
+
+// checkNestedOptions проверяет, что параметры вложенной транзакции не противоречат
+// параметрам внешней. Незаданные параметры наследуются
+func (t *txWrapper) checkNestedOptions(requested pgx.TxOptions) error {
+	switch {
+	case requested.BeginQuery != "":
+		return fmt.Errorf("%w: begin query is not supported for savepoints", ErrTxOptionsConflict)
+	case requested.IsoLevel != "" && requested.IsoLevel != t.options.IsoLevel:
+		return fmt.Errorf("%w: isolation level %q, outer transaction uses %q", ErrTxOptionsConflict, requested.IsoLevel, t.options.IsoLevel)
+	case requested.AccessMode != "" && (requested.AccessMode == pgx.ReadOnly) != t.readOnly:
+		return fmt.Errorf("%w: access mode %q, outer transaction read-only is %t", ErrTxOptionsConflict, requested.AccessMode, t.readOnly)
+	case requested.DeferrableMode != "" &&
+		(requested.DeferrableMode == pgx.Deferrable) != (t.options.DeferrableMode == pgx.Deferrable):
+		return fmt.Errorf("%w: deferrable mode %q, outer transaction uses %q", ErrTxOptionsConflict, requested.DeferrableMode, t.options.DeferrableMode)
+	}
+	return nil
 }
 
 // Ping не поддерживается в транзакции
@@ -144,7 +269,14 @@ func (t *txWrapper) Close(ctx context.Context) error {
 
 // Commit фиксирует транзакцию
 func (t *txWrapper) Commit(ctx context.Context) error {
-	err := t.tx.Commit(ctx)
+	ctx, op, err := t.startOperation(ctx, OperationCommit, "", nil)
+	if err != nil {
+		return err
+	}
+
+	t.finished = true
+	err = t.tx.Commit(ctx)
+	op.end(err)
 	if err != nil {
 		if t.db.telemetry != nil {
 			t.db.telemetry.RecordError()
@@ -152,11 +284,33 @@ func (t *txWrapper) Commit(ctx context.Context) error {
 		return fmt.Errorf("error committing transaction: %w", err)
 	}
 
+	// Освобождение точки сохранения и транзакция только для чтения не фиксируют изменения
+	if !t.nested && !t.readOnly {
+		t.db.captureCommitLSN(ctx)
+	}
 	return nil
 }
 
-// Rollback откатывает транзакцию
+// Rollback откатывает транзакцию. Ошибка перехватчика не отменяет откат,
+// чтобы подключение вернулось в пул, и возвращается после него
 func (t *txWrapper) Rollback(ctx context.Context) error {
+	if t.finished {
+		return t.rollback(ctx)
+	}
+	t.finished = true
+
+	ctx, op, err := t.startOperation(ctx, OperationRollback, "", nil)
+	if err != nil {
+		return errors.Join(err, t.rollback(ctx))
+	}
+
+	err = t.rollback(ctx)
+	op.end(err)
+	return err
+}
+
+// rollback откатывает транзакцию pgx
+func (t *txWrapper) rollback(ctx context.Context) error {
 	err := t.tx.Rollback(ctx)
 	if err != nil {
 		if t.db.telemetry != nil {